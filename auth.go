@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	servertiming "github.com/mitchellh/go-server-timing"
+	"github.com/pkg/errors"
+)
+
+// SSO is the configuration of EVE SSO (OAuth2) login.
+type SSO struct {
+	ClientID     string
+	ClientSecret string
+	// Callback is the registered callback URL of the application, which
+	// must be routed to SSOCallback.
+	Callback string
+	// Addr is the base URL of the SSO server.
+	Addr string
+	// JWKSAddr is the URL of the JSON Web Key Set used to verify tokens.
+	JWKSAddr string
+	Scopes   string
+	// FrontendURL is where users are sent after logging in.
+	FrontendURL string
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey
+}
+
+const (
+	sessionCookie = "session"
+	sessionTTL    = time.Hour * 24 * 30
+	// ssoStateCookie ties a login's state to the browser that started it,
+	// so a login can't be completed in another user's browser.
+	ssoStateCookie = "sso_state"
+	// ssoStateTTL is how long a user has to complete a login.
+	ssoStateTTL = time.Minute * 10
+)
+
+// Session is a logged in character.
+type Session struct {
+	ID            string `json:"-"`
+	CharacterID   int32
+	CharacterName string
+	AccessToken   string    `json:"-"`
+	RefreshToken  string    `json:"-"`
+	TokenExpires  time.Time `json:"-"`
+}
+
+type sessionKey struct{}
+
+// SessionFromContext returns the logged in character of a request, or nil
+// if there isn't one.
+func SessionFromContext(ctx context.Context) *Session {
+	sess, _ := ctx.Value(sessionKey{}).(*Session)
+	return sess
+}
+
+// loadSession returns the session of r's session cookie, or nil if there
+// isn't a valid one.
+func (s *EFContext) loadSession(ctx context.Context, r *http.Request) (*Session, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return nil, nil
+	}
+	sess := &Session{ID: c.Value}
+	if err := s.DB.QueryRowContext(ctx, `
+		SELECT
+			character, name, access_token, refresh_token, token_expires
+		FROM
+			sessions
+		WHERE
+			id = $1 AND created > $2
+	`, sess.ID, time.Now().Add(-sessionTTL)).Scan(
+		&sess.CharacterID,
+		&sess.CharacterName,
+		&sess.AccessToken,
+		&sess.RefreshToken,
+		&sess.TokenExpires,
+	); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// allowOrigin sets the CORS headers of w for r. The frontend's origin is
+// allowed to send credentials (the session cookie).
+func (s *EFContext) allowOrigin(w http.ResponseWriter, r *http.Request) {
+	// The headers depend on the origin, so caches must not share a
+	// response between origins.
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin != "" && origin == strings.TrimSuffix(s.CORSOrigin, "/") {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+}
+
+// isSecure reports whether r was made over HTTPS, directly or through a
+// proxy.
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// pkceChallenge returns the S256 PKCE code challenge of verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Login redirects to EVE SSO to log in.
+func (s *EFContext) Login(w http.ResponseWriter, r *http.Request) {
+	if s.SSO.ClientID == "" {
+		http.Error(w, "login not configured", http.StatusNotFound)
+		return
+	}
+	state := randomID(18)
+	verifier := randomID(32)
+	if _, err := s.DB.ExecContext(r.Context(), `
+		INSERT INTO sso_states (state, verifier, created) VALUES ($1, $2, now())
+	`, state, verifier); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(ssoStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	v := url.Values{
+		"response_type":         {"code"},
+		"redirect_uri":          {s.SSO.Callback},
+		"client_id":             {s.SSO.ClientID},
+		"scope":                 {s.SSO.Scopes},
+		"state":                 {state},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, s.SSO.Addr+"/v2/oauth/authorize?"+v.Encode(), http.StatusFound)
+}
+
+// SSOCallback completes a login started by Login, creates a session, and
+// redirects to the frontend.
+func (s *EFContext) SSOCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	state := r.FormValue("state")
+	c, err := r.Cookie(ssoStateCookie)
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoStateCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+		http.Error(w, "login was not started by this browser", http.StatusBadRequest)
+		return
+	}
+	sess, err := s.ssoCallback(ctx, state, r.FormValue("code"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The frontend can be on another site, which only gets the session
+	// cookie if it's SameSite=None. Browsers require that to be Secure, so
+	// plain HTTP (development, where both are on localhost) uses Lax.
+	sameSite := http.SameSiteLaxMode
+	if isSecure(r) {
+		sameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    sess.ID,
+		Path:     "/",
+		MaxAge:   int(sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: sameSite,
+	})
+	redirect := s.SSO.FrontendURL
+	if redirect == "" {
+		redirect = "/"
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (s *EFContext) ssoCallback(ctx context.Context, state, code string) (*Session, error) {
+	if state == "" || code == "" {
+		return nil, errors.New("missing state or code")
+	}
+	var verifier string
+	if err := s.DB.QueryRowContext(ctx, `
+		DELETE FROM sso_states WHERE state = $1 AND created > $2 RETURNING verifier
+	`, state, time.Now().Add(-ssoStateTTL)).Scan(&verifier); err == sql.ErrNoRows {
+		return nil, errors.New("unknown or expired login")
+	} else if err != nil {
+		return nil, err
+	}
+	tok, err := s.SSO.token(ctx, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"code_verifier": {verifier},
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, err := s.SSO.verify(ctx, tok.AccessToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "verify token")
+	}
+	sess := &Session{
+		ID:            randomID(32),
+		CharacterID:   claims.characterID(),
+		CharacterName: claims.Name,
+		AccessToken:   tok.AccessToken,
+		RefreshToken:  tok.RefreshToken,
+		TokenExpires:  tok.expires(),
+	}
+	if sess.CharacterID == 0 {
+		return nil, errors.Errorf("bad token subject: %s", claims.Subject)
+	}
+	if _, err := s.DB.ExecContext(ctx, `
+		INSERT
+		INTO
+			sessions
+				(
+					id,
+					character,
+					name,
+					access_token,
+					refresh_token,
+					token_expires,
+					created
+				)
+		VALUES
+			($1, $2, $3, $4, $5, $6, now())
+	`, sess.ID, sess.CharacterID, sess.CharacterName, sess.AccessToken, sess.RefreshToken, sess.TokenExpires); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// accessToken returns the access token of sess, first refreshing and
+// storing it if it has or is about to expire.
+func (s *EFContext) accessToken(ctx context.Context, sess *Session) (string, error) {
+	if time.Now().Add(time.Minute).Before(sess.TokenExpires) {
+		return sess.AccessToken, nil
+	}
+	tok, err := s.SSO.token(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {sess.RefreshToken},
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "refresh")
+	}
+	// The refresh token may be rotated.
+	if tok.RefreshToken == "" {
+		tok.RefreshToken = sess.RefreshToken
+	}
+	if _, err := s.DB.ExecContext(ctx, `
+		UPDATE
+			sessions
+		SET
+			access_token = $2, refresh_token = $3, token_expires = $4
+		WHERE
+			id = $1
+	`, sess.ID, tok.AccessToken, tok.RefreshToken, tok.expires()); err != nil {
+		return "", err
+	}
+	sess.AccessToken = tok.AccessToken
+	sess.RefreshToken = tok.RefreshToken
+	sess.TokenExpires = tok.expires()
+	return sess.AccessToken, nil
+}
+
+type ssoToken struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+
+	received time.Time
+}
+
+func (t *ssoToken) expires() time.Time {
+	return t.received.Add(time.Duration(t.ExpiresIn) * time.Second)
+}
+
+// token requests a token from the SSO token endpoint with form values v.
+func (c *SSO) token(ctx context.Context, v url.Values) (*ssoToken, error) {
+	v.Set("client_id", c.ClientID)
+	req, err := http.NewRequest(http.MethodPost, c.Addr+"/v2/oauth/token", strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if c.ClientSecret != "" {
+		req.SetBasicAuth(c.ClientID, c.ClientSecret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "sso token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("sso token: %s", resp.Status)
+	}
+	tok := &ssoToken{received: time.Now()}
+	if err := json.NewDecoder(resp.Body).Decode(tok); err != nil {
+		return nil, errors.Wrap(err, "sso token")
+	}
+	return tok, nil
+}
+
+type ssoClaims struct {
+	Subject  string          `json:"sub"`
+	Name     string          `json:"name"`
+	Issuer   string          `json:"iss"`
+	Expires  int64           `json:"exp"`
+	Audience json.RawMessage `json:"aud"`
+}
+
+// characterID returns the character ID of a subject like
+// CHARACTER:EVE:123.
+func (c *ssoClaims) characterID() int32 {
+	const prefix = "CHARACTER:EVE:"
+	if !strings.HasPrefix(c.Subject, prefix) {
+		return 0
+	}
+	id, _ := strconv.ParseInt(strings.TrimPrefix(c.Subject, prefix), 10, 32)
+	return int32(id)
+}
+
+// verify verifies the RS256 signature, issuer, audience and expiry of a
+// JWT access token and returns its claims.
+func (c *SSO) verify(ctx context.Context, token string) (*ssoClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, errors.Wrap(err, "header")
+	}
+	if header.Alg != "RS256" {
+		return nil, errors.Errorf("unsupported alg: %s", header.Alg)
+	}
+	key, err := c.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "signature")
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, errors.Wrap(err, "signature")
+	}
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "claims")
+	}
+	var claims ssoClaims
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return nil, errors.Wrap(err, "claims")
+	}
+	if time.Now().Unix() > claims.Expires {
+		return nil, errors.New("token expired")
+	}
+	if u, err := url.Parse(c.Addr); err != nil || (claims.Issuer != u.Host && claims.Issuer != c.Addr) {
+		return nil, errors.Errorf("bad issuer: %s", claims.Issuer)
+	}
+	// aud can be a string or array of strings.
+	var aud []string
+	if err := json.Unmarshal(claims.Audience, &aud); err != nil {
+		var one string
+		if err := json.Unmarshal(claims.Audience, &one); err != nil {
+			return nil, errors.Wrap(err, "audience")
+		}
+		aud = []string{one}
+	}
+	found := false
+	for _, a := range aud {
+		if a == c.ClientID {
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.New("token not issued for this client")
+	}
+	return &claims, nil
+}
+
+// key returns the JWKS key with id kid. Keys are fetched when kid is
+// unknown so that key rotation works.
+func (c *SSO) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, c.JWKSAddr, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "jwks")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("jwks: %s", resp.Status)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, errors.Wrap(err, "jwks")
+	}
+	c.keys = map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "jwks n")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.Wrap(err, "jwks e")
+		}
+		c.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	key, ok := c.keys[kid]
+	if !ok {
+		return nil, errors.Errorf("unknown key: %s", kid)
+	}
+	return key, nil
+}
+
+// DeleteExpired deletes expired sessions and logins that were never
+// completed.
+func (s *EFContext) DeleteExpired(ctx context.Context) {
+	now := time.Now()
+	if _, err := s.DB.ExecContext(ctx, `DELETE FROM sso_states WHERE created < $1`, now.Add(-ssoStateTTL)); err != nil {
+		log.Printf("delete expired logins: %+v", err)
+	}
+	if _, err := s.DB.ExecContext(ctx, `DELETE FROM sessions WHERE created < $1`, now.Add(-sessionTTL)); err != nil {
+		log.Printf("delete expired sessions: %+v", err)
+	}
+}
+
+// Me returns the logged in character and their collections and doctrines,
+// or nil if not logged in.
+func (s *EFContext) Me(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	sess := SessionFromContext(ctx)
+	if sess == nil {
+		return nil, nil
+	}
+	var ret struct {
+		*Session
+		Collections []struct {
+			ID, Key, Name string
+		}
+		Doctrines []struct {
+			ID, Key, Name string
+		}
+	}
+	ret.Session = sess
+	if err := s.X.SelectContext(ctx, &ret.Collections, `
+		SELECT
+			id, key, name
+		FROM
+			collections
+		WHERE
+			owner = $1
+		ORDER BY
+			created DESC
+	`, sess.CharacterID); err != nil {
+		return nil, err
+	}
+	err := s.X.SelectContext(ctx, &ret.Doctrines, `
+		SELECT
+			id, key, name
+		FROM
+			doctrines
+		WHERE
+			owner = $1
+		ORDER BY
+			created DESC
+	`, sess.CharacterID)
+	return ret, err
+}
+
+// Logout deletes the current session.
+func (s *EFContext) Logout(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	if err := requirePost(r); err != nil {
+		return nil, err
+	}
+	sess := SessionFromContext(ctx)
+	if sess == nil {
+		return nil, nil
+	}
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM sessions WHERE id = $1`, sess.ID)
+	return nil, err
+}
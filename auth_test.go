@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT returns an RS256 JWT of claims signed by key with key ID kid.
+func signJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims interface{}) string {
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": "RS256", "kid": kid}) + "." + enc(claims)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "JWT-Signature-Key",
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	defer jwks.Close()
+
+	sso := &SSO{
+		ClientID: "client",
+		Addr:     "https://login.eveonline.com",
+		JWKSAddr: jwks.URL,
+	}
+	claims := func(f func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":  "CHARACTER:EVE:123",
+			"name": "Pilot",
+			"iss":  "login.eveonline.com",
+			"exp":  time.Now().Add(time.Minute).Unix(),
+			"aud":  []string{"client", "EVE Online"},
+		}
+		if f != nil {
+			f(c)
+		}
+		return c
+	}
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{
+			name:  "valid",
+			token: signJWT(t, key, "JWT-Signature-Key", claims(nil)),
+		},
+		{
+			name: "string audience and URL issuer",
+			token: signJWT(t, key, "JWT-Signature-Key", claims(func(c map[string]interface{}) {
+				c["aud"] = "client"
+				c["iss"] = "https://login.eveonline.com"
+			})),
+		},
+		{
+			name:  "bad signature",
+			token: signJWT(t, other, "JWT-Signature-Key", claims(nil)),
+			err:   "signature",
+		},
+		{
+			name:  "unknown key",
+			token: signJWT(t, key, "other", claims(nil)),
+			err:   "unknown key",
+		},
+		{
+			name: "bad issuer",
+			token: signJWT(t, key, "JWT-Signature-Key", claims(func(c map[string]interface{}) {
+				c["iss"] = "login.example.com"
+			})),
+			err: "bad issuer",
+		},
+		{
+			name: "bad audience",
+			token: signJWT(t, key, "JWT-Signature-Key", claims(func(c map[string]interface{}) {
+				c["aud"] = []string{"someone else"}
+			})),
+			err: "not issued for this client",
+		},
+		{
+			name: "expired",
+			token: signJWT(t, key, "JWT-Signature-Key", claims(func(c map[string]interface{}) {
+				c["exp"] = time.Now().Add(-time.Minute).Unix()
+			})),
+			err: "expired",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := sso.verify(context.Background(), tc.token)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id := got.characterID(); id != 123 {
+				t.Errorf("got character %d, want 123", id)
+			}
+		})
+	}
+
+	// A tampered payload fails even with a valid signature.
+	tok := signJWT(t, key, "JWT-Signature-Key", claims(nil))
+	parts := strings.Split(tok, ".")
+	b, _ := json.Marshal(claims(func(c map[string]interface{}) { c["sub"] = "CHARACTER:EVE:456" }))
+	parts[1] = base64.RawURLEncoding.EncodeToString(b)
+	if _, err := sso.verify(context.Background(), strings.Join(parts, ".")); err == nil {
+		t.Error("tampered token verified")
+	}
+}
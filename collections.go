@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	servertiming "github.com/mitchellh/go-server-timing"
+	"github.com/pkg/errors"
+)
+
+// Collections are server-side lists of saved fits. Each collection has a
+// public ID that can be shared to view it, and a secret key required to
+// change it. Collections created while logged in are owned by that
+// character, who can change them without the key.
+
+// randomID returns a random URL-safe string of n bytes of entropy.
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// csrfHeader must be set on requests that change data. Browsers only send
+// it cross-origin after a CORS preflight, which only the frontend's origin
+// passes with credentials, so other sites can't use a visitor's session.
+const csrfHeader = "X-Requested-With"
+
+// requirePost returns an error unless r is a POST from the frontend or a
+// non-browser client.
+func requirePost(r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return errors.New("must POST")
+	}
+	if r.Header.Get(csrfHeader) == "" {
+		return errors.Errorf("missing %s header", csrfHeader)
+	}
+	return nil
+}
+
+// checkKey verifies that the key form value is the key of the row of
+// table (collections or doctrines) with the id form value, or that the
+// logged in character owns it, and returns the id.
+func (s *EFContext) checkKey(ctx context.Context, r *http.Request, table string) (string, error) {
+	id := r.FormValue("id")
+	if id == "" {
+		return "", errors.New("missing id")
+	}
+	var key string
+	var owner sql.NullInt32
+	if err := s.DB.QueryRowContext(ctx, `SELECT key, owner FROM `+table+` WHERE id = $1`, id).Scan(&key, &owner); err == sql.ErrNoRows {
+		return "", errors.Errorf("unknown id: %s", id)
+	} else if err != nil {
+		return "", err
+	}
+	if sess := SessionFromContext(ctx); sess != nil && owner.Valid && owner.Int32 == sess.CharacterID {
+		return id, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(r.FormValue("key"))) != 1 {
+		return "", errors.New("bad key")
+	}
+	return id, nil
+}
+
+// sessionOwner returns the logged in character as an owner, or NULL.
+func sessionOwner(ctx context.Context) sql.NullInt32 {
+	var owner sql.NullInt32
+	if sess := SessionFromContext(ctx); sess != nil {
+		owner = nullInt32(sess.CharacterID)
+	}
+	return owner
+}
+
+// CollectionCreate creates a collection named by the name form value and
+// returns its ID and key.
+func (s *EFContext) CollectionCreate(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	if err := requirePost(r); err != nil {
+		return nil, err
+	}
+	var ret struct {
+		ID, Key, Name string
+	}
+	ret.ID = randomID(9)
+	ret.Key = randomID(18)
+	ret.Name = strings.TrimSpace(r.FormValue("name"))
+	if _, err := s.DB.ExecContext(ctx, `
+		INSERT
+		INTO
+			collections (id, key, name, owner, created)
+		VALUES
+			($1, $2, $3, $4, now())
+	`, ret.ID, ret.Key, ret.Name, sessionOwner(ctx)); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// CollectionAdd adds or updates the note of the killmail km in a
+// collection.
+func (s *EFContext) CollectionAdd(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	if err := requirePost(r); err != nil {
+		return nil, err
+	}
+	id, err := s.checkKey(ctx, r, "collections")
+	if err != nil {
+		return nil, err
+	}
+	km, _ := strconv.Atoi(r.FormValue("km"))
+	if km <= 0 {
+		return nil, errors.New("missing km")
+	}
+	var exists bool
+	if err := s.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM killmails WHERE id = $1)`, km).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.Errorf("unknown killmail: %d", km)
+	}
+	if _, err := s.DB.ExecContext(ctx, `
+		INSERT
+		INTO
+			collection_fits (collection, killmail, note, added)
+		VALUES
+			($1, $2, $3, now())
+		ON CONFLICT
+			(collection, killmail)
+		DO
+			UPDATE SET note = excluded.note
+	`, id, km, r.FormValue("note")); err != nil {
+		return nil, err
+	}
+	return s.collection(ctx, id)
+}
+
+// CollectionRemove removes the killmail km from a collection.
+func (s *EFContext) CollectionRemove(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	if err := requirePost(r); err != nil {
+		return nil, err
+	}
+	id, err := s.checkKey(ctx, r, "collections")
+	if err != nil {
+		return nil, err
+	}
+	km, _ := strconv.Atoi(r.FormValue("km"))
+	if _, err := s.DB.ExecContext(ctx, `DELETE FROM collection_fits WHERE collection = $1 AND killmail = $2`, id, km); err != nil {
+		return nil, err
+	}
+	return s.collection(ctx, id)
+}
+
+// Collection returns the fits of the collection with the id form value.
+func (s *EFContext) Collection(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	id := r.FormValue("id")
+	if id == "" {
+		return nil, errors.New("missing collection id")
+	}
+	return s.collection(ctx, id)
+}
+
+// CollectionFit is a fit saved in a collection.
+type CollectionFit struct {
+	*FitResult
+	Note  string
+	Added time.Time
+}
+
+// CollectionResult is a collection and its fits. Names are of the
+// characters, corporations, and alliances of all its fits.
+type CollectionResult struct {
+	ID    string
+	Name  string
+	Names map[int32]string
+	Fits  []CollectionFit
+}
+
+func (s *EFContext) collection(ctx context.Context, id string) (*CollectionResult, error) {
+	ret := &CollectionResult{
+		ID: id,
+	}
+	if err := s.DB.QueryRowContext(ctx, `SELECT name FROM collections WHERE id = $1`, id).Scan(&ret.Name); err == sql.ErrNoRows {
+		return nil, errors.New("unknown collection")
+	} else if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Killmail int32
+		Note     string
+		Added    time.Time
+		KM, Zkb  []byte
+	}
+	if err := s.X.SelectContext(ctx, &rows, `
+		SELECT
+			cf.killmail, cf.note, cf.added, k.km, k.zkb
+		FROM
+			collection_fits AS cf
+			JOIN killmails AS k ON k.id = cf.killmail
+		WHERE
+			cf.collection = $1
+		ORDER BY
+			cf.added DESC
+	`, id); err != nil {
+		return nil, err
+	}
+	var ids []int32
+	for _, row := range rows {
+		var km KM
+		if err := json.Unmarshal(row.KM, &km); err != nil {
+			return nil, errors.Wrapf(err, "fit %d", row.Killmail)
+		}
+		var zkb Zkb
+		json.Unmarshal(row.Zkb, &zkb)
+		fit := s.fitResult(row.Killmail, km, zkb)
+		fit.Violations, fit.Warnings = km.Validate(s)
+		ids = append(ids, fit.nameIDs()...)
+		ret.Fits = append(ret.Fits, CollectionFit{
+			FitResult: fit,
+			Note:      row.Note,
+			Added:     row.Added,
+		})
+	}
+	ret.Names = s.ResolveNames(ctx, ids)
+	return ret, nil
+}
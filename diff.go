@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+
+	servertiming "github.com/mitchellh/go-server-timing"
+	"github.com/pkg/errors"
+)
+
+// ChargeChange is a module fitted in both fits whose loaded charge differs.
+// From or To is nil if the module is unloaded in that fit.
+type ChargeChange struct {
+	Module Item
+	From   *Item `json:",omitempty"`
+	To     *Item `json:",omitempty"`
+}
+
+// FitSlotDiff is the differences between two fits in a slot type.
+type FitSlotDiff struct {
+	Added   []Item         `json:",omitempty"`
+	Removed []Item         `json:",omitempty"`
+	Changed []ChargeChange `json:",omitempty"`
+}
+
+// FitDiff compares the fits of killmails a and b. For each slot type with
+// differences it returns the modules of b not in a (Added), the modules of
+// a not in b (Removed), and the modules fitted in both whose charges
+// differ (Changed).
+func (s *EFContext) FitDiff(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	a, _ := strconv.Atoi(r.FormValue("a"))
+	b, _ := strconv.Atoi(r.FormValue("b"))
+	if a <= 0 || b <= 0 {
+		return nil, errors.New("missing a or b")
+	}
+	kms, err := s.loadKillmails(ctx, []int32{int32(a), int32(b)})
+	if err != nil {
+		return nil, err
+	}
+	kmA, kmB := kms[int32(a)], kms[int32(b)]
+
+	type Fit struct {
+		Killmail int32
+		Ship     Item
+	}
+	var ret struct {
+		A, B  Fit
+		Same  bool
+		Slots map[string]FitSlotDiff
+	}
+	ret.A = Fit{Killmail: int32(a), Ship: s.Global.Items[kmA.Victim.ShipTypeId]}
+	ret.B = Fit{Killmail: int32(b), Ship: s.Global.Items[kmB.Victim.ShipTypeId]}
+	ret.Slots = map[string]FitSlotDiff{}
+
+	hiA, medA, lowA, rigA, subA, _ := kmA.Items(s)
+	hiB, medB, lowB, rigB, subB, _ := kmB.Items(s)
+	slotsA := [][8]ItemCharge{hiA, medA, lowA, rigA, subA}
+	slotsB := [][8]ItemCharge{hiB, medB, lowB, rigB, subB}
+	diff := kmA.Modules(s).Diff(kmB.Modules(s))
+	for i, slot := range SlotTypes {
+		var sd FitSlotDiff
+		for _, id := range diff.Extra[i] {
+			sd.Added = append(sd.Added, s.Global.Items[id])
+		}
+		for _, id := range diff.Missing[i] {
+			sd.Removed = append(sd.Removed, s.Global.Items[id])
+		}
+		sd.Changed = s.chargeChanges(slotsA[i], slotsB[i])
+		if sd.Added != nil || sd.Removed != nil || sd.Changed != nil {
+			ret.Slots[slot] = sd
+		}
+	}
+	ret.Same = ret.A.Ship.ID == ret.B.Ship.ID && len(ret.Slots) == 0
+	return ret, nil
+}
+
+// chargeChanges returns the charge changes of modules fitted in both a and
+// b. Charges that match between instances of the same module are ignored;
+// the rest are paired up in type ID order.
+func (s *EFContext) chargeChanges(a, b [8]ItemCharge) []ChargeChange {
+	chargesOf := func(slots [8]ItemCharge) map[int32][]int32 {
+		m := map[int32][]int32{}
+		for _, ic := range slots {
+			if ic.ID <= 0 {
+				continue
+			}
+			var charge int32
+			if ic.Charge != nil {
+				charge = ic.Charge.ID
+			}
+			m[ic.ID] = append(m[ic.ID], charge)
+		}
+		return m
+	}
+	chargesA, chargesB := chargesOf(a), chargesOf(b)
+	var modules []int32
+	for id := range chargesA {
+		if _, ok := chargesB[id]; ok {
+			modules = append(modules, id)
+		}
+	}
+	sort.Slice(modules, func(i, j int) bool { return modules[i] < modules[j] })
+
+	var ret []ChargeChange
+	for _, id := range modules {
+		from, to := diffIDs(chargesA[id], chargesB[id])
+		sort.Slice(from, func(i, j int) bool { return from[i] < from[j] })
+		sort.Slice(to, func(i, j int) bool { return to[i] < to[j] })
+		for j := 0; j < len(from) && j < len(to); j++ {
+			ret = append(ret, ChargeChange{
+				Module: s.Global.Items[id],
+				From:   s.chargeItem(from[j]),
+				To:     s.chargeItem(to[j]),
+			})
+		}
+	}
+	return ret
+}
+
+func (s *EFContext) chargeItem(id int32) *Item {
+	if id == 0 {
+		return nil
+	}
+	item := s.Global.Items[id]
+	return &item
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	servertiming "github.com/mitchellh/go-server-timing"
+	"github.com/pkg/errors"
+)
+
+// Doctrines are reference fits, imported from EFT, that losses of the same
+// ship can be compared against. Like collections they have a public ID and
+// a secret key required to change them, and are owned by the character
+// that created them while logged in. A doctrine can be limited to the
+// losses of a corporation or alliance.
+
+// DoctrineCreate creates a doctrine from the eft form value, named by the
+// name form value or else the EFT fitting name, and returns its ID and key.
+// The optional corporation and alliance form values limit the losses
+// compared against it.
+func (s *EFContext) DoctrineCreate(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	if err := requirePost(r); err != nil {
+		return nil, err
+	}
+	fit, err := s.ParseEFT(r.FormValue("eft"))
+	if err != nil {
+		return nil, err
+	}
+	corporation, alliance := doctrineScope(r)
+	var ret struct {
+		ID, Key, Name string
+	}
+	ret.Name = strings.TrimSpace(r.FormValue("name"))
+	if ret.Name == "" {
+		ret.Name = fit.Name
+	}
+	ret.ID, ret.Key, err = s.createDoctrine(ctx, ret.Name, r.FormValue("eft"), fit, corporation, alliance)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// doctrineScope returns the corporation and alliance form values, or NULL
+// if not set.
+func doctrineScope(r *http.Request) (corporation, alliance sql.NullInt32) {
+	if v, _ := strconv.Atoi(r.FormValue("corporation")); v > 0 {
+		corporation = nullInt32(int32(v))
+	}
+	if v, _ := strconv.Atoi(r.FormValue("alliance")); v > 0 {
+		alliance = nullInt32(int32(v))
+	}
+	return corporation, alliance
+}
+
+// createDoctrine stores a doctrine of fit, parsed from eft, and returns its
+// ID and key.
+func (s *EFContext) createDoctrine(
+	ctx context.Context, name, eft string, fit *EFT, corporation, alliance sql.NullInt32,
+) (id, key string, err error) {
+	modules, err := json.Marshal(fit.Modules)
+	if err != nil {
+		return "", "", err
+	}
+	id = randomID(9)
+	key = randomID(18)
+	if _, err := s.DB.ExecContext(ctx, `
+		INSERT
+		INTO
+			doctrines (id, key, name, owner, ship, eft, modules, corporation, alliance, created)
+		VALUES
+			($1, $2, $3, $4, $5, $6, $7, $8, $9, now())
+	`, id, key, name, sessionOwner(ctx), fit.Ship.ID, eft, modules, corporation, alliance); err != nil {
+		return "", "", err
+	}
+	return id, key, nil
+}
+
+// DoctrineDelete deletes a doctrine.
+func (s *EFContext) DoctrineDelete(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	if err := requirePost(r); err != nil {
+		return nil, err
+	}
+	id, err := s.checkKey(ctx, r, "doctrines")
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.DB.ExecContext(ctx, `DELETE FROM doctrines WHERE id = $1`, id)
+	return nil, err
+}
+
+// SlotDiff is the modules of a slot type missing from or extra to a fit
+// compared to a reference fit.
+type SlotDiff struct {
+	Missing []Item `json:",omitempty"`
+	Extra   []Item `json:",omitempty"`
+}
+
+// slotDiffs converts d to SlotDiffs keyed by slot type, omitting slot types
+// without differences.
+func (s *EFContext) slotDiffs(d ModulesDiff) map[string]SlotDiff {
+	ret := map[string]SlotDiff{}
+	for i, slot := range SlotTypes {
+		var sd SlotDiff
+		for _, id := range d.Missing[i] {
+			sd.Missing = append(sd.Missing, s.Global.Items[id])
+		}
+		for _, id := range d.Extra[i] {
+			sd.Extra = append(sd.Extra, s.Global.Items[id])
+		}
+		if sd.Missing != nil || sd.Extra != nil {
+			ret[slot] = sd
+		}
+	}
+	return ret
+}
+
+// Doctrine returns the doctrine with the id form value and its most recent
+// losses, each with its differences from the doctrine fit. limit (default
+// 50, max 500) is the number of losses. If deviated is set, only losses
+// that differ from the doctrine are returned.
+func (s *EFContext) Doctrine(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	id := r.FormValue("id")
+	if id == "" {
+		return nil, errors.New("missing doctrine id")
+	}
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	deviated := r.FormValue("deviated") != ""
+
+	var doctrine struct {
+		Name        string
+		Ship        int32
+		EFT         string
+		Modules     []byte
+		Corporation sql.NullInt32
+		Alliance    sql.NullInt32
+	}
+	if err := s.DB.QueryRowContext(ctx, `
+		SELECT
+			name, ship, eft, modules, corporation, alliance
+		FROM
+			doctrines
+		WHERE
+			id = $1
+	`, id).Scan(&doctrine.Name, &doctrine.Ship, &doctrine.EFT, &doctrine.Modules, &doctrine.Corporation, &doctrine.Alliance); err == sql.ErrNoRows {
+		return nil, errors.New("unknown doctrine")
+	} else if err != nil {
+		return nil, err
+	}
+	var modules Modules
+	if err := json.Unmarshal(doctrine.Modules, &modules); err != nil {
+		return nil, err
+	}
+
+	type Loss struct {
+		Killmail  int32
+		Killtime  time.Time
+		Character int32
+		Cost      int64
+		Score     float64
+		Diff      map[string]SlotDiff
+	}
+	var ret struct {
+		ID          string
+		Name        string
+		Ship        Item
+		EFT         string
+		Corporation int32 `json:",omitempty"`
+		Alliance    int32 `json:",omitempty"`
+		Losses      []Loss
+		// Deviated is the number of Losses that differ from the doctrine.
+		Deviated int
+		Names    map[int32]string
+	}
+	ret.ID = id
+	ret.Name = doctrine.Name
+	ret.Ship = s.Global.Items[doctrine.Ship]
+	ret.EFT = doctrine.EFT
+	ret.Corporation = doctrine.Corporation.Int32
+	ret.Alliance = doctrine.Alliance.Int32
+
+	// Deviated losses are filtered after diffing, so fetch more rows than
+	// needed for them.
+	fetch := limit
+	if deviated {
+		fetch *= 4
+	}
+	selectT := timing.NewMetric("select").Start()
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT
+			f.killmail, f.killtime, COALESCE(f.character, 0), COALESCE(f.cost, 0), k.km
+		FROM
+			fits AS f
+			JOIN killmails AS k ON k.id = f.killmail
+		WHERE
+			f.ship = $1
+			AND ($2::INT4 IS NULL OR f.corporation = $2)
+			AND ($3::INT4 IS NULL OR f.alliance = $3)
+		ORDER BY
+			f.killmail DESC
+		LIMIT
+			$4
+	`, doctrine.Ship, doctrine.Corporation, doctrine.Alliance, fetch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int32{ret.Corporation, ret.Alliance}
+	for rows.Next() && len(ret.Losses) < limit {
+		var loss Loss
+		var raw []byte
+		if err := rows.Scan(&loss.Killmail, &loss.Killtime, &loss.Character, &loss.Cost, &raw); err != nil {
+			return nil, err
+		}
+		var km KM
+		if err := json.Unmarshal(raw, &km); err != nil {
+			return nil, err
+		}
+		have := km.Modules(s)
+		diff := modules.Diff(have)
+		if diff.Empty() {
+			if deviated {
+				continue
+			}
+		} else {
+			ret.Deviated++
+		}
+		loss.Score = modules.Similarity(have)
+		loss.Diff = s.slotDiffs(diff)
+		ret.Losses = append(ret.Losses, loss)
+		ids = append(ids, loss.Character)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	selectT.Stop()
+	namesT := timing.NewMetric("names").Start()
+	ret.Names = s.ResolveNames(ctx, ids)
+	namesT.Stop()
+	return ret, nil
+}
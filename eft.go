@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EFT is a fitting parsed from the EFT text format.
+type EFT struct {
+	Ship    Item
+	Name    string
+	Modules Modules
+	// Charges are the loaded charges of modules, keyed by module type ID.
+	Charges map[int32]int32
+}
+
+// eftSections are the slot type indexes into Modules of each EFT section.
+var eftSections = []int{2, 1, 0, 3, 4}
+
+// eftSlotNames are the names of slot types in EFT empty slot placeholders,
+// indexed in SlotTypes order.
+var eftSlotNames = [...]string{"High", "Med", "Low", "Rig", "Subsystem"}
+
+// ParseEFT parses a fitting in the EFT format used by the game client and
+// pyfa:
+//
+//	[Drake, My Drake]
+//	Ballistic Control System II
+//
+//	Large Shield Extender II
+//
+//	Heavy Missile Launcher II, Scourge Heavy Missile
+//
+// Sections are separated by blank lines and are in low, med, high, rig,
+// subsystem order. Drones and cargo (lines with an xN quantity) and
+// anything but subsystems after the rig section, like implants, are
+// ignored.
+func (s *EFContext) ParseEFT(text string) (*EFT, error) {
+	fit := &EFT{
+		Charges: map[int32]int32{},
+	}
+	sc := bufio.NewScanner(strings.NewReader(text))
+	section := 0
+	inSection := false
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if fit.Ship.ID == 0 {
+			if line == "" {
+				continue
+			}
+			if !strings.HasPrefix(line, "[") || !strings.HasSuffix(line, "]") {
+				return nil, errors.Errorf("expected [ship, name] header: %s", line)
+			}
+			parts := strings.SplitN(strings.Trim(line, "[]"), ",", 2)
+			ship, ok := s.ItemByName(parts[0])
+			if !ok || !s.Global.Groups[ship.Group].IsShip() {
+				return nil, errors.Errorf("unknown ship: %s", parts[0])
+			}
+			fit.Ship = ship
+			if len(parts) > 1 {
+				fit.Name = strings.TrimSpace(parts[1])
+			}
+			continue
+		}
+		if line == "" {
+			if inSection {
+				section++
+				inSection = false
+			}
+			continue
+		}
+		inSection = true
+		if section >= len(eftSections) {
+			continue
+		}
+		// Empty slot placeholders like [Empty Low slot].
+		if strings.HasPrefix(line, "[") {
+			continue
+		}
+		line = strings.TrimSuffix(line, "/OFFLINE")
+		line = strings.TrimSpace(line)
+		parts := strings.SplitN(line, ",", 2)
+		name := strings.TrimSpace(parts[0])
+		if idx := strings.LastIndex(name, " x"); idx > 0 && isDigits(name[idx+2:]) {
+			continue
+		}
+		slot := eftSections[section]
+		item, ok := s.ItemByName(name)
+		group := s.Global.Groups[item.Group]
+		switch {
+		case ok && group.IsSubsystem():
+			slot = 4
+		case slot == 4:
+			// Ships without subsystems can be followed by implant and
+			// booster sections, which aren't known items.
+			continue
+		case !ok:
+			return nil, errors.Errorf("unknown item: %s", name)
+		case !group.IsModule():
+			continue
+		}
+		fit.Modules[slot] = append(fit.Modules[slot], item.ID)
+		if len(parts) > 1 {
+			if charge, ok := s.ItemByName(strings.TrimSpace(parts[1])); ok {
+				fit.Charges[item.ID] = charge.ID
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if fit.Ship.ID == 0 {
+		return nil, errors.New("empty fitting")
+	}
+	return fit, nil
+}
+
+// Format returns f in the EFT format read by ParseEFT.
+func (f *EFT) Format(s *EFContext) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "[%s, %s]\n", f.Ship.Name, f.Name)
+	last := 0
+	for i, slot := range eftSections {
+		if len(f.Modules[slot]) > 0 {
+			last = i
+		}
+	}
+	for i, slot := range eftSections[:last+1] {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		// ParseEFT, like the game, needs a placeholder to tell an empty
+		// section from consecutive blank lines.
+		if len(f.Modules[slot]) == 0 {
+			fmt.Fprintf(&sb, "[Empty %s slot]\n", eftSlotNames[slot])
+		}
+		for _, id := range f.Modules[slot] {
+			sb.WriteString(s.Global.Items[id].Name)
+			if charge, ok := f.Charges[id]; ok {
+				fmt.Fprintf(&sb, ", %s", s.Global.Items[charge].Name)
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	servertiming "github.com/mitchellh/go-server-timing"
+	"github.com/pkg/errors"
+)
+
+// Fit pages and oEmbed let links to fits unfurl in chat apps, which don't
+// run the frontend's JavaScript. /fit/{id} must be routed here for them.
+
+const (
+	siteName = "fittin.gs"
+	// renderSize is the size of ship render thumbnails.
+	renderSize = 512
+)
+
+// fitPreview is the link preview of a fit.
+type fitPreview struct {
+	Title       string
+	Description string
+	// URL is the frontend page of the fit.
+	URL   string
+	Image string
+}
+
+// preview returns the link preview of killmail id: its ship, modules, cost
+// and location. site is the base URL of the fit's page. Unlike fit, names
+// aren't resolved and the fit isn't validated, since previews are fetched
+// by bots for every link.
+func (s *EFContext) preview(ctx context.Context, id int32, site string) (*fitPreview, error) {
+	var rawKM []byte
+	var cost sql.NullInt64
+	if err := s.DB.QueryRowContext(ctx, `
+		SELECT
+			k.km, f.cost
+		FROM
+			killmails AS k LEFT JOIN fits AS f ON f.killmail = k.id
+		WHERE
+			k.id = $1
+	`, id).Scan(&rawKM, &cost); err != nil {
+		return nil, errors.Wrap(err, "killmail")
+	}
+	var km KM
+	if err := json.Unmarshal(rawKM, &km); err != nil {
+		return nil, err
+	}
+	hi, med, low, rig, sub, _ := km.Items(s)
+	ship := s.Global.Items[km.Victim.ShipTypeId]
+	system := s.Global.Systems[km.SolarSystemId]
+
+	// Modules are summarized per slot type, like 3x Heavy Missile
+	// Launcher II.
+	var modules []string
+	for _, slots := range [][8]ItemCharge{hi, med, low, rig, sub} {
+		var order []int32
+		counts := map[int32]int{}
+		for _, ic := range slots {
+			if ic.ID <= 0 {
+				continue
+			}
+			if counts[ic.ID] == 0 {
+				order = append(order, ic.ID)
+			}
+			counts[ic.ID]++
+		}
+		for _, id := range order {
+			name := s.Global.Items[id].Name
+			if counts[id] > 1 {
+				name = fmt.Sprintf("%dx %s", counts[id], name)
+			}
+			modules = append(modules, name)
+		}
+	}
+	description := strings.Join(modules, ", ")
+	if cost.Int64 > 0 {
+		description = fmt.Sprintf("%.2fM ISK. %s", float64(cost.Int64)/1e6, description)
+	}
+	if system.Name != "" {
+		description = fmt.Sprintf("Lost in %s (%s). %s", system.Name, s.Global.Regions[system.Region].Name, description)
+	}
+	return &fitPreview{
+		Title:       fmt.Sprintf("%s fit %d", ship.Name, id),
+		Description: description,
+		URL:         fmt.Sprintf("%s/fit/%d", site, id),
+		Image:       fmt.Sprintf("https://images.evetech.net/types/%d/render?size=%d", ship.ID, renderSize),
+	}, nil
+}
+
+// siteURL returns the base URL of the frontend for link previews: SiteURL,
+// or the SSO frontend URL if it isn't set.
+func (s *EFContext) siteURL() string {
+	if s.SiteURL != "" {
+		return strings.TrimSuffix(s.SiteURL, "/")
+	}
+	return strings.TrimSuffix(s.SSO.FrontendURL, "/")
+}
+
+var fitPageTemplate = template.Must(template.New("fit").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} - {{.Site}}</title>
+<meta name="description" content="{{.Description}}">
+<meta property="og:site_name" content="{{.Site}}">
+<meta property="og:type" content="website">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.URL}}">
+<meta property="og:image" content="{{.Image}}">
+<meta name="twitter:card" content="summary">
+<meta name="twitter:title" content="{{.Title}}">
+<meta name="twitter:description" content="{{.Description}}">
+<meta name="twitter:image" content="{{.Image}}">
+<link rel="canonical" href="{{.URL}}">
+<link rel="alternate" type="application/json+oembed" href="{{.OEmbed}}" title="{{.Title}}">
+<script>if (location.host !== {{.Host}}) location.replace({{.URL}});</script>
+</head>
+<body>
+<h1><a href="{{.URL}}">{{.Title}}</a></h1>
+<p>{{.Description}}</p>
+</body>
+</html>
+`))
+
+// FitPage serves /fit/{id} as an HTML page with OpenGraph and Twitter card
+// metadata of the fit. Browsers are redirected to the frontend's page of
+// the fit. The frontend's host can route /fit/* here for previews, so
+// browsers are only redirected if they aren't already on that host, which
+// would loop. The page is cached, so it doesn't depend on the request's
+// host.
+func (s *EFContext) FitPage(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(strings.Trim(strings.TrimPrefix(r.URL.Path, "/fit/"), "/"))
+	if id <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	meta, err := s.preview(r.Context(), int32(id), s.siteURL())
+	if errors.Cause(err) == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("%s: %+v", r.URL, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var host string
+	if u, err := url.Parse(meta.URL); err == nil {
+		host = u.Host
+	}
+	data := struct {
+		*fitPreview
+		Site   string
+		OEmbed string
+		Host   string
+	}{
+		fitPreview: meta,
+		Site:       siteName,
+		OEmbed:     strings.TrimSuffix(s.APIURL, "/") + "/api/OEmbed?" + url.Values{"url": {meta.URL}}.Encode(),
+		Host:       host,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	if err := fitPageTemplate.Execute(w, data); err != nil {
+		log.Printf("%s: %+v", r.URL, err)
+	}
+}
+
+// OEmbed returns the oEmbed (https://oembed.com) link preview of the fit
+// page at the url form value.
+func (s *EFContext) OEmbed(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	if format := r.FormValue("format"); format != "" && format != "json" {
+		return nil, errors.Errorf("unsupported format: %s", format)
+	}
+	u, err := url.Parse(r.FormValue("url"))
+	if err != nil {
+		return nil, err
+	}
+	idx := strings.LastIndex(u.Path, "/fit/")
+	if idx < 0 {
+		return nil, errors.New("not a fit url")
+	}
+	id, _ := strconv.Atoi(strings.Trim(u.Path[idx+len("/fit/"):], "/"))
+	if id <= 0 {
+		return nil, errors.New("not a fit url")
+	}
+	meta, err := s.preview(ctx, int32(id), s.siteURL())
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Version         string `json:"version"`
+		Type            string `json:"type"`
+		Title           string `json:"title"`
+		ProviderName    string `json:"provider_name"`
+		ProviderURL     string `json:"provider_url"`
+		ThumbnailURL    string `json:"thumbnail_url"`
+		ThumbnailWidth  int    `json:"thumbnail_width"`
+		ThumbnailHeight int    `json:"thumbnail_height"`
+	}{
+		Version: "1.0",
+		Type:    "link",
+		// oEmbed has no description, so it is part of the title.
+		Title:           meta.Title + ": " + meta.Description,
+		ProviderName:    siteName,
+		ProviderURL:     s.siteURL(),
+		ThumbnailURL:    meta.Image,
+		ThumbnailWidth:  renderSize,
+		ThumbnailHeight: renderSize,
+	}, nil
+}
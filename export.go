@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	servertiming "github.com/mitchellh/go-server-timing"
+	"github.com/pkg/errors"
+)
+
+// parseQuantity parses a value of the form key or key:quantity. quantity
+// defaults to 1.
+func parseQuantity(v string) (key string, quantity int, err error) {
+	idx := strings.IndexByte(v, ':')
+	if idx < 0 {
+		return v, 1, nil
+	}
+	quantity, err = strconv.Atoi(v[idx+1:])
+	if err != nil || quantity <= 0 {
+		return "", 0, errors.Errorf("bad quantity: %s", v)
+	}
+	return v[:idx], quantity, nil
+}
+
+// loadKillmails returns the killmails with ids.
+func (s *EFContext) loadKillmails(ctx context.Context, ids []int32) (map[int32]KM, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT id, km FROM killmails WHERE id = ANY ($1::INT4[])`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	kms := map[int32]KM{}
+	for rows.Next() {
+		var id int32
+		var raw []byte
+		if err := rows.Scan(&id, &raw); err != nil {
+			return nil, err
+		}
+		var km KM
+		if err := json.Unmarshal(raw, &km); err != nil {
+			return nil, err
+		}
+		kms[id] = km
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, ok := kms[id]; !ok {
+			return nil, errors.Errorf("unknown killmail: %d", id)
+		}
+	}
+	return kms, nil
+}
+
+// fitQuantities parses the km and fingerprint form values, each with an
+// optional :quantity suffix, into killmail IDs and the number of each to
+// use. Fingerprints use their most recent killmail.
+func (s *EFContext) fitQuantities(ctx context.Context, r *http.Request) (ids []int32, quantities map[int32]int, err error) {
+	r.ParseForm()
+	quantities = map[int32]int{}
+	add := func(id int32, n int) {
+		if _, ok := quantities[id]; !ok {
+			ids = append(ids, id)
+		}
+		quantities[id] += n
+	}
+	for _, v := range r.Form["km"] {
+		key, n, err := parseQuantity(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		id, _ := strconv.Atoi(key)
+		if id <= 0 {
+			return nil, nil, errors.Errorf("bad killmail: %s", v)
+		}
+		add(int32(id), n)
+	}
+	for _, v := range r.Form["fingerprint"] {
+		key, n, err := parseQuantity(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		var id int32
+		if err := s.DB.QueryRowContext(ctx, `
+			SELECT
+				killmail
+			FROM
+				fits
+			WHERE
+				fingerprint = $1
+			ORDER BY
+				killmail DESC
+			LIMIT
+				1
+		`, key).Scan(&id); err != nil {
+			return nil, nil, errors.Wrapf(err, "fingerprint %s", key)
+		}
+		add(id, n)
+	}
+	if len(ids) == 0 {
+		return nil, nil, errors.New("missing km or fingerprint")
+	}
+	return ids, quantities, nil
+}
+
+// Multibuy returns a consolidated shopping list of the ships, modules and
+// charges of fits. The km and fingerprint form values select fits and can
+// have a :quantity suffix, like km=1234:5. Text is in the in-game multibuy
+// format.
+func (s *EFContext) Multibuy(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	ids, fits, err := s.fitQuantities(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	kms, err := s.loadKillmails(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	type Line struct {
+		Item
+		Quantity int64
+	}
+	var ret struct {
+		Fits  map[int32]int
+		Items []Line
+		Text  string
+	}
+	ret.Fits = fits
+	total := map[int32]int64{}
+	for id, n := range fits {
+		for typ, q := range kms[id].Quantities() {
+			total[typ] += q * int64(n)
+		}
+	}
+	for typ, q := range total {
+		item := s.Global.Items[typ]
+		item.ID = typ
+		ret.Items = append(ret.Items, Line{
+			Item:     item,
+			Quantity: q,
+		})
+	}
+	sort.Slice(ret.Items, func(i, j int) bool {
+		return ret.Items[i].Name < ret.Items[j].Name
+	})
+	var sb strings.Builder
+	for _, l := range ret.Items {
+		if l.Name == "" {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s x%d\n", l.Name, l.Quantity)
+	}
+	ret.Text = sb.String()
+	return ret, nil
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	servertiming "github.com/mitchellh/go-server-timing"
+	"github.com/pkg/errors"
+)
+
+// xmlFittings is the XML fittings format of the in-game fitting manager
+// and pyfa:
+//
+//	<fittings>
+//		<fitting name="My Drake">
+//			<description value=""/>
+//			<shipType value="Drake"/>
+//			<hardware slot="low slot 0" type="Ballistic Control System II"/>
+//			<hardware qty="5" slot="drone bay" type="Hornet II"/>
+//		</fitting>
+//	</fittings>
+type xmlFittings struct {
+	XMLName  xml.Name     `xml:"fittings"`
+	Fittings []xmlFitting `xml:"fitting"`
+}
+
+type xmlFitting struct {
+	Name        string        `xml:"name,attr"`
+	Description xmlValue      `xml:"description"`
+	ShipType    xmlValue      `xml:"shipType"`
+	Hardware    []xmlHardware `xml:"hardware"`
+}
+
+type xmlValue struct {
+	Value string `xml:"value,attr"`
+}
+
+type xmlHardware struct {
+	Qty  int64  `xml:"qty,attr,omitempty"`
+	Slot string `xml:"slot,attr"`
+	Type string `xml:"type,attr"`
+}
+
+// xmlSlotTypes are the XML slot name prefixes, indexed in SlotTypes order.
+var xmlSlotTypes = [...]string{"hi slot", "med slot", "low slot", "rig slot", "subsystem slot"}
+
+// fittingItem is an item of a saved fitting.
+type fittingItem struct {
+	Flag     Slot
+	Type     int32
+	Quantity int64
+}
+
+// fittingItems returns the items of km to save in a fitting: modules in
+// their slots, and drones and loaded charges (which fittings can't hold in
+// modules) in the drone bay and cargo.
+func (s *EFContext) fittingItems(km KM) []fittingItem {
+	var items []fittingItem
+	hi, med, low, rig, sub, _ := km.Items(s)
+	for i, slots := range [][8]ItemCharge{hi, med, low, rig, sub} {
+		for n, ic := range slots {
+			if ic.ID > 0 {
+				items = append(items, fittingItem{
+					Flag:     slot0s[i] + Slot(n),
+					Type:     ic.ID,
+					Quantity: 1,
+				})
+			}
+		}
+	}
+	var drones, cargo []fittingItem
+	// The index of each type in drones and cargo, so quantities of a type
+	// are combined.
+	droneIndex, cargoIndex := map[int32]int{}, map[int32]int{}
+	for _, i := range km.Victim.Items {
+		item := s.Global.Items[i.ItemTypeId]
+		flag := Slot(i.Flag)
+		list, index := &cargo, cargoIndex
+		switch {
+		case flag == SlotDroneBay:
+			list, index = &drones, droneIndex
+		case flag.Type() != "" && s.Global.Groups[item.Group].IsCharge():
+			flag = SlotCargo
+		default:
+			continue
+		}
+		n := KMItem(i).Quantity()
+		if idx, ok := index[i.ItemTypeId]; ok {
+			(*list)[idx].Quantity += n
+			continue
+		}
+		index[i.ItemTypeId] = len(*list)
+		*list = append(*list, fittingItem{
+			Flag:     flag,
+			Type:     i.ItemTypeId,
+			Quantity: n,
+		})
+	}
+	items = append(items, drones...)
+	return append(items, cargo...)
+}
+
+// slot0s are the first slots of each slot type, indexed in SlotTypes order.
+var slot0s = [...]Slot{HiSlot0, MedSlot0, LoSlot0, RigSlot0, SubSlot0}
+
+// slotIndex returns the index in SlotTypes of the slot type of flag and
+// the slot number within it, or -1 if flag isn't a fitting slot.
+func slotIndex(flag Slot) (int, Slot) {
+	for i, slot := range SlotTypes {
+		if flag.Type() == slot {
+			return i, flag - slot0s[i]
+		}
+	}
+	return -1, 0
+}
+
+// xmlFitting converts km to an XML fitting.
+func (s *EFContext) xmlFitting(id int32, km KM) xmlFitting {
+	ship := s.Global.Items[km.Victim.ShipTypeId]
+	fit := xmlFitting{
+		Name:        fmt.Sprintf("%s %d", ship.Name, id),
+		Description: xmlValue{fmt.Sprintf("Killmail %d", id)},
+		ShipType:    xmlValue{ship.Name},
+	}
+	for _, item := range s.fittingItems(km) {
+		// The XML format refers to types by name, so types we don't know
+		// can't be written.
+		name := s.Global.Items[item.Type].Name
+		if name == "" {
+			continue
+		}
+		h := xmlHardware{
+			Type: name,
+		}
+		switch i, n := slotIndex(item.Flag); {
+		case i >= 0:
+			h.Slot = fmt.Sprintf("%s %d", xmlSlotTypes[i], n)
+		case item.Flag == SlotDroneBay:
+			h.Slot = "drone bay"
+			h.Qty = item.Quantity
+		default:
+			h.Slot = "cargo"
+			h.Qty = item.Quantity
+		}
+		fit.Hardware = append(fit.Hardware, h)
+	}
+	return fit
+}
+
+// FittingsExport writes the fits selected by the km and fingerprint form
+// values (see Multibuy; quantities are ignored) as an XML fittings file
+// that can be imported in game.
+func (s *EFContext) FittingsExport(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	ids, _, err := s.fitQuantities(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	kms, err := s.loadKillmails(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	var fittings xmlFittings
+	for _, id := range ids {
+		fittings.Fittings = append(fittings.Fittings, s.xmlFitting(id, kms[id]))
+	}
+	b, err := xml.MarshalIndent(fittings, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		ContentType: "application/xml",
+		Name:        "fittings.xml",
+		Data:        append([]byte(xml.Header), b...),
+	}, nil
+}
+
+// parseXMLFittings parses an XML fittings file. Drones and cargo are
+// ignored.
+func (s *EFContext) parseXMLFittings(text string) ([]*EFT, error) {
+	var fittings xmlFittings
+	if err := xml.Unmarshal([]byte(text), &fittings); err != nil {
+		return nil, err
+	}
+	var fits []*EFT
+	for _, f := range fittings.Fittings {
+		ship, ok := s.ItemByName(f.ShipType.Value)
+		if !ok || !s.Global.Groups[ship.Group].IsShip() {
+			return nil, errors.Errorf("%s: unknown ship: %s", f.Name, f.ShipType.Value)
+		}
+		fit := &EFT{
+			Ship:    ship,
+			Name:    f.Name,
+			Charges: map[int32]int32{},
+		}
+		for _, h := range f.Hardware {
+			slot := -1
+			for i, prefix := range xmlSlotTypes {
+				if strings.HasPrefix(h.Slot, prefix+" ") {
+					slot = i
+				}
+			}
+			if slot < 0 {
+				continue
+			}
+			item, ok := s.ItemByName(h.Type)
+			if !ok {
+				return nil, errors.Errorf("%s: unknown item: %s", f.Name, h.Type)
+			}
+			fit.Modules[slot] = append(fit.Modules[slot], item.ID)
+		}
+		fits = append(fits, fit)
+	}
+	if len(fits) == 0 {
+		return nil, errors.New("no fittings")
+	}
+	return fits, nil
+}
+
+// fitsQuery returns the Fits query string of fits with the ship and modules
+// of fit.
+func fitsQuery(fit *EFT) string {
+	v := url.Values{}
+	v.Set("ship", strconv.Itoa(int(fit.Ship.ID)))
+	for i, slot := range SlotTypes {
+		seen := map[int32]bool{}
+		var ids []int
+		for _, id := range fit.Modules[i] {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, int(id))
+			}
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			v.Add(slot, strconv.Itoa(id))
+		}
+	}
+	return v.Encode()
+}
+
+// FittingsImport parses the xml form value, an XML fittings file. Each
+// fitting is returned in EFT format with the Fits query string of fits
+// with its modules. If doctrines is set, a doctrine is also created for
+// each fitting, limited to the optional corporation and alliance form
+// values.
+func (s *EFContext) FittingsImport(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	if err := requirePost(r); err != nil {
+		return nil, err
+	}
+	fits, err := s.parseXMLFittings(r.FormValue("xml"))
+	if err != nil {
+		return nil, err
+	}
+	createDoctrines := r.FormValue("doctrines") != ""
+	corporation, alliance := doctrineScope(r)
+
+	type Doctrine struct {
+		ID, Key string
+	}
+	type Fitting struct {
+		Name     string
+		Ship     Item
+		EFT      string
+		Query    string
+		Doctrine *Doctrine `json:",omitempty"`
+	}
+	var ret []Fitting
+	for _, fit := range fits {
+		f := Fitting{
+			Name:  fit.Name,
+			Ship:  fit.Ship,
+			EFT:   fit.Format(s),
+			Query: fitsQuery(fit),
+		}
+		if createDoctrines {
+			id, key, err := s.createDoctrine(ctx, fit.Name, f.EFT, fit, corporation, alliance)
+			if err != nil {
+				return nil, errors.Wrap(err, fit.Name)
+			}
+			f.Doctrine = &Doctrine{ID: id, Key: key}
+		}
+		ret = append(ret, f)
+	}
+	return ret, nil
+}
+
+// esiSlotTypes are the ESI fitting flag prefixes, indexed in SlotTypes
+// order.
+var esiSlotTypes = [...]string{"HiSlot", "MedSlot", "LoSlot", "RigSlot", "SubSystemSlot"}
+
+// esiFittingNameLen is the maximum length of an in-game fitting name.
+const esiFittingNameLen = 50
+
+// FittingSave saves the fit of killmail km to the in-game fittings of the
+// logged in character, named by the optional name form value, and returns
+// the new fitting's ID.
+func (s *EFContext) FittingSave(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	if err := requirePost(r); err != nil {
+		return nil, err
+	}
+	sess := SessionFromContext(ctx)
+	if sess == nil {
+		return nil, errors.New("not logged in")
+	}
+	id, _ := strconv.Atoi(r.FormValue("km"))
+	if id <= 0 {
+		return nil, errors.New("missing km")
+	}
+	kms, err := s.loadKillmails(ctx, []int32{int32(id)})
+	if err != nil {
+		return nil, err
+	}
+	km := kms[int32(id)]
+
+	type esiItem struct {
+		Flag     string `json:"flag"`
+		Quantity int64  `json:"quantity"`
+		TypeID   int32  `json:"type_id"`
+	}
+	var fitting struct {
+		Name        string    `json:"name"`
+		Description string    `json:"description"`
+		ShipTypeID  int32     `json:"ship_type_id"`
+		Items       []esiItem `json:"items"`
+	}
+	fitting.Name = strings.TrimSpace(r.FormValue("name"))
+	if fitting.Name == "" {
+		fitting.Name = fmt.Sprintf("%s %d", s.Global.Items[km.Victim.ShipTypeId].Name, id)
+	}
+	if name := []rune(fitting.Name); len(name) > esiFittingNameLen {
+		fitting.Name = string(name[:esiFittingNameLen])
+	}
+	fitting.Description = fmt.Sprintf("Killmail %d", id)
+	fitting.ShipTypeID = km.Victim.ShipTypeId
+	for _, item := range s.fittingItems(km) {
+		flag := "Cargo"
+		switch i, n := slotIndex(item.Flag); {
+		case i >= 0:
+			flag = fmt.Sprintf("%s%d", esiSlotTypes[i], n)
+		case item.Flag == SlotDroneBay:
+			flag = "DroneBay"
+		}
+		fitting.Items = append(fitting.Items, esiItem{
+			Flag:     flag,
+			Quantity: item.Quantity,
+			TypeID:   item.Type,
+		})
+	}
+
+	token, err := s.accessToken(ctx, sess)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(fitting)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/characters/%d/fittings/", s.ESIAddr, sess.CharacterID), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "esi")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		var res struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&res)
+		return nil, errors.Errorf("esi: %s %s", resp.Status, res.Error)
+	}
+	var ret struct {
+		FittingID int64 `json:"fitting_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, errors.Wrap(err, "decode")
+	}
+	return ret, nil
+}
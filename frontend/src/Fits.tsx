@@ -63,17 +63,13 @@ export default function Fits() {
 				<div className={flexChildrenClass}>
 					{Object.entries(data.Filter).map(([type, items]) =>
 						items.map(item => (
-							<div key={item.ID} className="ma1">
+							<div key={type + item.Value} className="ma1">
 								filter by {type}: {item.Name}
 								{item.Group ? (
 									<Link
 										to={makeURL(
 											addParam(
-												removeParam(
-													window.location.search,
-													type,
-													item.ID.toString()
-												),
+												removeParam(window.location.search, type, item.Value),
 												'group',
 												item.Group.toString()
 											)
@@ -89,13 +85,15 @@ export default function Fits() {
 										history.push(
 											window.location.pathname +
 												'?' +
-												removeParam(location.search, type, item.ID.toString())
+												removeParam(location.search, type, item.Value)
 										)
 									}
 								>
 									x
 								</button>
-								<Ref ID={item.ID} />
+								{item.ID && itemFilters.includes(type) ? (
+									<Ref ID={item.ID} />
+								) : null}
 							</div>
 						))
 					)}
@@ -221,11 +219,28 @@ function SlotSummary(props: { items: ItemCharge[] }) {
 	);
 }
 
+// itemFilters are the filters whose values are type IDs.
+const itemFilters = [
+	'ship',
+	'item',
+	'not_item',
+	'hi',
+	'med',
+	'low',
+	'rig',
+	'sub',
+];
+
+interface FilterItem {
+	ID?: number;
+	Name: string;
+	Group?: number;
+	// Value is the query parameter value of the filter.
+	Value: string;
+}
+
 interface FitsData {
-	Filter: {
-		item: ItemCharge[];
-		ship: ItemCharge[];
-	};
+	Filter: { [type: string]: FilterItem[] };
 	Fits: FitSummary[];
 }
 
@@ -26,13 +26,40 @@ async function Fetch<T>(
 	path: string,
 	success: (data: T) => void,
 	onErr?: (error: any) => void
+) {
+	request(path, {}, success, onErr);
+}
+
+// FetchSession is Fetch for endpoints that use the logged in session, which
+// need the session cookie. If body is set it is POSTed with the header the
+// API requires of requests that change data.
+async function FetchSession<T>(
+	path: string,
+	success: (data: T) => void,
+	onErr?: (error: any) => void,
+	body?: URLSearchParams
+) {
+	const init: RequestInit = { credentials: 'include' };
+	if (body) {
+		init.method = 'POST';
+		init.body = body;
+		init.headers = { 'X-Requested-With': 'fetch' };
+	}
+	request(path, init, success, onErr);
+}
+
+async function request<T>(
+	path: string,
+	init: RequestInit,
+	success: (data: T) => void,
+	onErr?: (error: any) => void
 ) {
 	const url = baseURL + path;
 	if (!onErr) {
 		onErr = console.error;
 	}
 	try {
-		const resp = await fetch(url);
+		const resp = await fetch(url, init);
 		const data = await resp.json();
 		success(data);
 	} catch (error) {
@@ -129,6 +156,7 @@ export const savedPrefix = 'saved-';
 export {
 	createCookie,
 	Fetch,
+	FetchSession,
 	flexChildrenClass,
 	Icon,
 	ISK,
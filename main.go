@@ -11,10 +11,14 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/pkg/errors"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -28,6 +32,33 @@ var (
 type Specification struct {
 	Port    string `default:"4001"`
 	DB_Addr string `default:"postgres://root@localhost:26257/ef?sslmode=disable"`
+	// ESI_Addr is the base URL of ESI, used to resolve names and save
+	// in-game fittings.
+	ESI_Addr string `default:"https://esi.evetech.net/latest"`
+	// Prices_Addr is a URL or file of item prices in the format of ESI's
+	// /markets/prices/, or a CSV file.
+	Prices_Addr string `default:"https://esi.evetech.net/latest/markets/prices/"`
+	// Hub_Prices_Addr is a URL or file of a Fuzzwork-style aggregate CSV
+	// of trade hub prices. Hub prices aren't imported if empty.
+	Hub_Prices_Addr string `default:"https://market.fuzzwork.co.uk/aggregatecsv.csv.gz"`
+	// EVE SSO login is disabled if SSO_Client_ID is empty.
+	SSO_Client_ID     string
+	SSO_Client_Secret string
+	SSO_Callback      string `default:"http://localhost:4001/api/SSOCallback"`
+	SSO_Addr          string `default:"https://login.eveonline.com"`
+	SSO_JWKS_Addr     string `default:"https://login.eveonline.com/oauth/jwks"`
+	SSO_Scopes        string `default:"esi-fittings.write_fittings.v1"`
+	Frontend_URL      string `default:"http://localhost:3000/"`
+	// CORS_Origin is the origin of the frontend, which is allowed to make
+	// requests with the session cookie. The development frontend proxies
+	// the API, so doesn't need it.
+	CORS_Origin string `default:"https://fittin.gs"`
+	// Site_URL is the public URL of the site that link previews of fits
+	// link to. Frontend_URL is used if empty.
+	Site_URL string `default:"https://fittin.gs/"`
+	// API_URL is the public URL of this server, which fit pages link to
+	// for oEmbed.
+	API_URL string `default:"https://fittings-5anqu7dwna-uc.a.run.app/"`
 }
 
 func main() {
@@ -55,14 +86,31 @@ func main() {
 	fmt.Println("inited", dbURL)
 
 	s := &EFContext{
-		DB: db,
-		X:  sqlx.NewDb(db, "postgres"),
+		DB:            db,
+		X:             sqlx.NewDb(db, "postgres"),
+		ESIAddr:       strings.TrimSuffix(spec.ESI_Addr, "/"),
+		PricesAddr:    spec.Prices_Addr,
+		HubPricesAddr: spec.Hub_Prices_Addr,
+		SiteURL:       spec.Site_URL,
+		APIURL:        spec.API_URL,
+		CORSOrigin:    spec.CORS_Origin,
+		SSO: &SSO{
+			ClientID:     spec.SSO_Client_ID,
+			ClientSecret: spec.SSO_Client_Secret,
+			Callback:     spec.SSO_Callback,
+			Addr:         strings.TrimSuffix(spec.SSO_Addr, "/"),
+			JWKSAddr:     spec.SSO_JWKS_Addr,
+			Scopes:       spec.SSO_Scopes,
+			FrontendURL:  spec.Frontend_URL,
+		},
 	}
 
 	s.Init()
 
 	if *flagCreateTables {
 		s.CreateTables()
+	} else {
+		s.Migrate()
 	}
 
 	ctx := context.Background()
@@ -70,15 +118,42 @@ func main() {
 	if *flagSync {
 		go s.FetchHashes(ctx)
 		go s.ProcessFits(ctx)
+		go s.RollupTrends(ctx)
+		go s.SyncPrices(ctx)
+		go s.DeleteExpired(ctx)
 		fmt.Println("running sync")
 		select {}
 	}
 
 	mux := http.NewServeMux()
+	mux.Handle("/api/CoFitted", s.Wrap(s.CoFitted))
+	mux.Handle("/api/Collection", s.WrapUncached(s.Collection))
+	mux.Handle("/api/CollectionAdd", s.WrapUncached(s.CollectionAdd))
+	mux.Handle("/api/CollectionCreate", s.WrapUncached(s.CollectionCreate))
+	mux.Handle("/api/CollectionRemove", s.WrapUncached(s.CollectionRemove))
+	mux.Handle("/api/Doctrine", s.WrapUncached(s.Doctrine))
+	mux.Handle("/api/DoctrineCreate", s.WrapUncached(s.DoctrineCreate))
+	mux.Handle("/api/DoctrineDelete", s.WrapUncached(s.DoctrineDelete))
 	mux.Handle("/api/Fit", s.Wrap(s.Fit))
+	mux.Handle("/api/FitDiff", s.Wrap(s.FitDiff))
 	mux.Handle("/api/Fits", s.Wrap(s.Fits))
+	mux.Handle("/api/FittingSave", s.WrapUncached(s.FittingSave))
+	mux.Handle("/api/FittingsExport", s.Wrap(s.FittingsExport))
+	mux.Handle("/api/FittingsImport", s.WrapUncached(s.FittingsImport))
+	mux.Handle("/api/Multibuy", s.Wrap(s.Multibuy))
+	mux.HandleFunc("/api/Login", s.Login)
+	mux.Handle("/api/Logout", s.WrapUncached(s.Logout))
+	mux.Handle("/api/Me", s.WrapUncached(s.Me))
+	mux.Handle("/api/OEmbed", s.Wrap(s.OEmbed))
+	mux.Handle("/api/PopularFits", s.Wrap(s.PopularFits))
 	mux.Handle("/api/Search", s.Wrap(s.Search))
+	mux.Handle("/api/ShipStats", s.Wrap(s.ShipStats))
+	mux.Handle("/api/SimilarFits", s.Wrap(s.SimilarFits))
+	mux.HandleFunc("/api/SSOCallback", s.SSOCallback)
 	mux.HandleFunc("/api/Sync", s.Sync)
+	mux.Handle("/api/Threats", s.Wrap(s.Threats))
+	mux.Handle("/api/Trends", s.Wrap(s.Trends))
+	mux.HandleFunc("/fit/", s.FitPage)
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {})
 
 	fmt.Println("HTTP listen on addr:", spec.Port)
@@ -86,7 +161,7 @@ func main() {
 }
 
 func (s *EFContext) Init() {
-	const globalKey = "global"
+	const globalKey = "global-v4"
 
 	if _, err := s.DB.Exec(`CREATE TABLE IF NOT EXISTS config (key string primary key, val bytes)`); err != nil {
 		panic(err)
@@ -148,6 +223,136 @@ func (s *EFContext) Init() {
 				}
 			}
 		}
+		{
+			fmt.Println("reading typeDogma.yaml")
+			r, err := os.Open("sde/fsd/typeDogma.yaml")
+			if err != nil {
+				panic(err)
+			}
+			defer r.Close()
+			var yml map[int32]struct {
+				DogmaAttributes []struct {
+					AttributeID int32   `yaml:"attributeID"`
+					Value       float64 `yaml:"value"`
+				} `yaml:"dogmaAttributes"`
+				DogmaEffects []struct {
+					EffectID int32 `yaml:"effectID"`
+				} `yaml:"dogmaEffects"`
+			}
+			if err := yaml.NewDecoder(r).Decode(&yml); err != nil {
+				panic(err)
+			}
+			s.Global.Dogma = map[int32]Dogma{}
+			for id, m := range yml {
+				if _, ok := s.Global.Items[id]; !ok {
+					continue
+				}
+				d := Dogma{
+					Attributes: map[int32]float64{},
+				}
+				for _, a := range m.DogmaAttributes {
+					if fittingAttributes[a.AttributeID] {
+						d.Attributes[a.AttributeID] = a.Value
+					}
+				}
+				for _, e := range m.DogmaEffects {
+					if fittingEffects[e.EffectID] {
+						d.Effects = append(d.Effects, e.EffectID)
+					}
+				}
+				s.Global.Dogma[id] = d
+			}
+		}
+		{
+			fmt.Println("reading invNames.yaml")
+			r, err := os.Open("sde/bsd/invNames.yaml")
+			if err != nil {
+				panic(err)
+			}
+			defer r.Close()
+			var yml []struct {
+				ItemID   int32  `yaml:"itemID"`
+				ItemName string `yaml:"itemName"`
+			}
+			if err := yaml.NewDecoder(r).Decode(&yml); err != nil {
+				panic(err)
+			}
+			names := map[int32]string{}
+			for _, n := range yml {
+				names[n.ItemID] = n.ItemName
+			}
+
+			fmt.Println("reading universe")
+			// Systems are stored in region/constellation/system
+			// directories. Map each directory to its ID so systems can
+			// find their parents after the walk.
+			dirIDs := map[string]int32{}
+			type sysDir struct {
+				sys System
+				dir string
+			}
+			var systems []sysDir
+			s.Global.Regions = map[int32]Region{}
+			s.Global.Constellations = map[int32]Constellation{}
+			s.Global.Systems = map[int32]System{}
+			if err := filepath.Walk("sde/fsd/universe", func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() || !strings.HasSuffix(path, ".staticdata") {
+					return nil
+				}
+				f, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				var yml struct {
+					RegionID        int32   `yaml:"regionID"`
+					ConstellationID int32   `yaml:"constellationID"`
+					SolarSystemID   int32   `yaml:"solarSystemID"`
+					Security        float32 `yaml:"security"`
+				}
+				if err := yaml.NewDecoder(f).Decode(&yml); err != nil {
+					return errors.Wrap(err, path)
+				}
+				dir := filepath.Dir(path)
+				switch filepath.Base(path) {
+				case "region.staticdata":
+					dirIDs[dir] = yml.RegionID
+					s.Global.Regions[yml.RegionID] = Region{
+						ID:   yml.RegionID,
+						Name: names[yml.RegionID],
+					}
+				case "constellation.staticdata":
+					dirIDs[dir] = yml.ConstellationID
+				case "solarsystem.staticdata":
+					systems = append(systems, sysDir{
+						sys: System{
+							ID:       yml.SolarSystemID,
+							Name:     names[yml.SolarSystemID],
+							Security: yml.Security,
+						},
+						dir: dir,
+					})
+				}
+				return nil
+			}); err != nil {
+				panic(err)
+			}
+			for _, sd := range systems {
+				constDir := filepath.Dir(sd.dir)
+				sys := sd.sys
+				sys.Constellation = dirIDs[constDir]
+				sys.Region = dirIDs[filepath.Dir(constDir)]
+				s.Global.Systems[sys.ID] = sys
+				s.Global.Constellations[sys.Constellation] = Constellation{
+					ID:     sys.Constellation,
+					Name:   names[sys.Constellation],
+					Region: sys.Region,
+				}
+			}
+		}
 		var b bytes.Buffer
 		if err := gob.NewEncoder(&b).Encode(s.Global); err != nil {
 			panic(err)
@@ -163,15 +368,91 @@ func (s *EFContext) Init() {
 			panic(err)
 		}
 	}
+
+	s.itemsByName = map[string]Item{}
+	for _, item := range s.Global.Items {
+		s.itemsByName[item.Lower] = item
+	}
+}
+
+// ItemByName returns the item with name, ignoring case.
+func (s *EFContext) ItemByName(name string) (Item, bool) {
+	item, ok := s.itemsByName[strings.ToLower(strings.TrimSpace(name))]
+	return item, ok
 }
 
 type EFContext struct {
 	DB *sql.DB
 	X  *sqlx.DB
+	// ESIAddr is the base URL of the ESI API.
+	ESIAddr string
+	// PricesAddr is the source of item prices.
+	PricesAddr string
+	// HubPricesAddr is the source of trade hub prices.
+	HubPricesAddr string
+	// SiteURL is the base URL of fit pages in link previews.
+	SiteURL string
+	// APIURL is the public base URL of this server.
+	APIURL string
+	// CORSOrigin is the origin allowed to send credentials.
+	CORSOrigin string
+	SSO        *SSO
 
 	Global struct {
-		Items  map[int32]Item
-		Groups map[int32]Group
+		Items          map[int32]Item
+		Groups         map[int32]Group
+		Systems        map[int32]System
+		Constellations map[int32]Constellation
+		Regions        map[int32]Region
+		Dogma          map[int32]Dogma
+	}
+	itemsByName map[string]Item
+
+	// namesMu guards namesRetry, the time after which ESI name lookups are
+	// retried after a failure.
+	namesMu    sync.Mutex
+	namesRetry time.Time
+}
+
+type Region struct {
+	ID   int32
+	Name string
+}
+
+type Constellation struct {
+	ID     int32
+	Name   string
+	Region int32
+}
+
+type System struct {
+	ID            int32
+	Name          string
+	Constellation int32
+	Region        int32
+	Security      float32
+}
+
+// Security bands of solar systems.
+const (
+	Highsec  = "highsec"
+	Lowsec   = "lowsec"
+	Nullsec  = "nullsec"
+	Wormhole = "wormhole"
+)
+
+// Band returns the security band of the system. Security is rounded the
+// same way the game client displays it.
+func (s System) Band() string {
+	switch {
+	case s.Region >= 11000000 && s.Region < 12000000:
+		return Wormhole
+	case s.Security >= 0.45:
+		return Highsec
+	case s.Security > 0:
+		return Lowsec
+	default:
+		return Nullsec
 	}
 }
 
@@ -181,9 +462,14 @@ type Group struct {
 	Category int32
 }
 
+// IsKnown reports whether g's types are loaded. Drones and fighters are
+// only loaded to name attacker weapons in Threats; they aren't stored
+// with fits or searchable.
 func (g Group) IsKnown() bool {
 	for _, f := range []func() bool{
 		g.IsCharge,
+		g.IsDrone,
+		g.IsFighter,
 		g.IsModule,
 		g.IsShip,
 		g.IsSubsystem,
@@ -199,6 +485,14 @@ func (g Group) IsCharge() bool {
 	return g.Category == 8
 }
 
+func (g Group) IsDrone() bool {
+	return g.Category == 18
+}
+
+func (g Group) IsFighter() bool {
+	return g.Category == 87
+}
+
 func (g Group) IsModule() bool {
 	return g.Category == 7
 }
@@ -211,6 +505,16 @@ func (g Group) IsSubsystem() bool {
 	return g.Category == 32
 }
 
+// categoryNames are the names of the categories of known groups.
+var categoryNames = map[int32]string{
+	6:  "Ship",
+	7:  "Module",
+	8:  "Charge",
+	18: "Drone",
+	32: "Subsystem",
+	87: "Fighter",
+}
+
 type Item struct {
 	ID    int32  `json:",omitempty"`
 	Name  string `json:",omitempty"`
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// nameTTL is how long resolved names are cached. Characters can be renamed
+// and corporations and alliances can change their names, but rarely.
+const nameTTL = time.Hour * 24 * 7
+
+// nameMissTTL is how long IDs that ESI couldn't resolve are cached.
+const nameMissTTL = time.Hour
+
+// esiNamesBatch is the maximum number of IDs ESI will resolve at once.
+const esiNamesBatch = 1000
+
+// esiNamesRetry is how long ESI name lookups are skipped after a failure so
+// that an ESI outage doesn't stall every request that shows names.
+const esiNamesRetry = time.Minute
+
+// esiClient is used for ESI requests made while serving a page, which
+// should give up well before the request does.
+var esiClient = &http.Client{Timeout: time.Second * 5}
+
+// ResolveNames returns the names of character, corporation and alliance
+// IDs. Names are cached in the names table and fetched from ESI when
+// missing or expired. IDs that can't be resolved are omitted; failing to
+// resolve names is logged but not returned as an error since names are
+// only informational.
+func (s *EFContext) ResolveNames(ctx context.Context, ids []int32) map[int32]string {
+	names := map[int32]string{}
+	seen := map[int32]bool{}
+	var unique []int32
+	for _, id := range ids {
+		if id <= 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		unique = append(unique, id)
+	}
+	if len(unique) == 0 {
+		return names
+	}
+
+	// IDs ESI couldn't resolve are cached with an empty name.
+	now := time.Now()
+	rows, err := s.DB.QueryContext(ctx, `
+		SELECT
+			id, name
+		FROM
+			names
+		WHERE
+			id = ANY ($1::INT4[])
+			AND updated > CASE WHEN name = '' THEN $3 ELSE $2 END
+	`, pq.Array(unique), now.Add(-nameTTL), now.Add(-nameMissTTL))
+	if err != nil {
+		log.Printf("resolve names: %+v", err)
+		return names
+	}
+	cached := map[int32]bool{}
+	for rows.Next() {
+		var id int32
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			log.Printf("resolve names: %+v", err)
+			break
+		}
+		cached[id] = true
+		if name != "" {
+			names[id] = name
+		}
+	}
+	rows.Close()
+
+	var missing []int32
+	for _, id := range unique {
+		if !cached[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return names
+	}
+	s.namesMu.Lock()
+	retry := s.namesRetry
+	s.namesMu.Unlock()
+	if now.Before(retry) {
+		return names
+	}
+	for len(missing) > 0 {
+		batch := missing
+		if len(batch) > esiNamesBatch {
+			batch = batch[:esiNamesBatch]
+		}
+		missing = missing[len(batch):]
+		if err := s.fetchNames(ctx, batch, names); err != nil {
+			log.Printf("resolve names: %+v", err)
+			s.namesMu.Lock()
+			s.namesRetry = time.Now().Add(esiNamesRetry)
+			s.namesMu.Unlock()
+			break
+		}
+	}
+	return names
+}
+
+// fetchNames resolves ids with ESI, adds them to names, and caches them.
+func (s *EFContext) fetchNames(ctx context.Context, ids []int32, names map[int32]string) error {
+	found, unknown, err := s.esiNames(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	var args []interface{}
+	now := time.Now()
+	add := func(id int32, category, name string) {
+		if len(args) > 0 {
+			sb.WriteString(", ")
+		}
+		args = append(args, id, category, name, now)
+		i := len(args)
+		fmt.Fprintf(&sb, "($%d, $%d, $%d, $%d)", i-3, i-2, i-1, i)
+	}
+	for _, r := range found {
+		names[r.ID] = r.Name
+		add(r.ID, r.Category, r.Name)
+	}
+	for _, id := range unknown {
+		add(id, "", "")
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	_, err = s.DB.ExecContext(ctx, `
+		UPSERT
+		INTO
+			names (id, category, name, updated)
+		VALUES
+			`+sb.String(), args...)
+	return errors.Wrap(err, "cache names")
+}
+
+type esiName struct {
+	Category string `json:"category"`
+	ID       int32  `json:"id"`
+	Name     string `json:"name"`
+}
+
+// esiNames resolves ids with ESI's /universe/names/. IDs ESI doesn't know
+// are returned in unknown.
+func (s *EFContext) esiNames(ctx context.Context, ids []int32) (found []esiName, unknown []int32, err error) {
+	body, err := json.Marshal(ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.ESIAddr+"/universe/names/", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := esiClient.Do(req)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "esi")
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(resp.Body).Decode(&found)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "decode")
+		}
+	case http.StatusNotFound:
+		resp.Body.Close()
+		// ESI fails the whole request if any ID is invalid, so split the
+		// batch to find the IDs it does know.
+		if len(ids) == 1 {
+			return nil, ids, nil
+		}
+		half := len(ids) / 2
+		for _, part := range [][]int32{ids[:half], ids[half:]} {
+			f, u, err := s.esiNames(ctx, part)
+			if err != nil {
+				return nil, nil, err
+			}
+			found = append(found, f...)
+			unknown = append(unknown, u...)
+		}
+		return found, unknown, nil
+	default:
+		resp.Body.Close()
+		return nil, nil, errors.Errorf("esi: %s", resp.Status)
+	}
+	returned := map[int32]bool{}
+	for _, r := range found {
+		returned[r.ID] = true
+	}
+	for _, id := range ids {
+		if !returned[id] {
+			unknown = append(unknown, id)
+		}
+	}
+	return found, unknown, nil
+}
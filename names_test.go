@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestESINames(t *testing.T) {
+	invalid := map[int32]bool{3: true, 6: true}
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Method != http.MethodPost || r.URL.Path != "/universe/names/" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		var ids []int32
+		if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res := []esiName{}
+		for _, id := range ids {
+			if invalid[id] {
+				http.Error(w, `{"error":"Ensure all IDs are valid before resolving."}`, http.StatusNotFound)
+				return
+			}
+			res = append(res, esiName{Category: "character", ID: id, Name: fmt.Sprint("char", id)})
+		}
+		json.NewEncoder(w).Encode(res)
+	}))
+	defer srv.Close()
+
+	s := &EFContext{ESIAddr: srv.URL}
+	found, unknown, err := s.esiNames(context.Background(), []int32{1, 2, 3, 4, 5, 6, 7, 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int32
+	for _, f := range found {
+		if f.Name != fmt.Sprint("char", f.ID) {
+			t.Errorf("%d: got name %q", f.ID, f.Name)
+		}
+		got = append(got, f.ID)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i] < unknown[j] })
+	if want := []int32{1, 2, 4, 5, 7, 8}; !reflect.DeepEqual(got, want) {
+		t.Errorf("found %v, want %v", got, want)
+	}
+	if want := []int32{3, 6}; !reflect.DeepEqual(unknown, want) {
+		t.Errorf("unknown %v, want %v", unknown, want)
+	}
+	if requests <= 1 {
+		t.Errorf("expected the batch to be split, got %d requests", requests)
+	}
+}
+
+func TestESINamesError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	s := &EFContext{ESIAddr: srv.URL}
+	if _, _, err := s.esiNames(context.Background(), []int32{1, 2}); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// openSource opens addr, which is either an HTTP(S) URL or a local file.
+func openSource(ctx context.Context, addr string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		return os.Open(strings.TrimPrefix(addr, "file://"))
+	}
+	req, err := http.NewRequest(http.MethodGet, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("%s: %s", addr, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// readPrices reads item prices from addr. JSON sources are in the format of
+// ESI's /markets/prices/. CSV sources (files ending in .csv) have a
+// type_id,price header.
+func readPrices(ctx context.Context, addr string) (map[int32]float64, error) {
+	r, err := openSource(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	prices := map[int32]float64{}
+	if strings.HasSuffix(addr, ".csv") {
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, errors.Wrap(err, "csv")
+		}
+		for i, rec := range records {
+			if i == 0 || len(rec) < 2 {
+				continue
+			}
+			id, err := strconv.Atoi(rec[0])
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", i+1)
+			}
+			price, err := strconv.ParseFloat(rec[1], 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", i+1)
+			}
+			prices[int32(id)] = price
+		}
+		return prices, nil
+	}
+	var res []struct {
+		TypeID        int32   `json:"type_id"`
+		AveragePrice  float64 `json:"average_price"`
+		AdjustedPrice float64 `json:"adjusted_price"`
+	}
+	if err := json.NewDecoder(r).Decode(&res); err != nil {
+		return nil, errors.Wrap(err, "json")
+	}
+	for _, p := range res {
+		price := p.AveragePrice
+		if price == 0 {
+			price = p.AdjustedPrice
+		}
+		prices[p.TypeID] = price
+	}
+	return prices, nil
+}
+
+// SyncPrices imports today's prices and hub prices, and prices killmails without a cost.
+func (s *EFContext) SyncPrices(ctx context.Context) {
+	s.ImportPrices(ctx)
+	s.ImportHubPrices(ctx)
+	s.PriceFits(ctx)
+}
+
+// ImportPrices imports today's item prices into the prices table if they
+// haven't been already.
+func (s *EFContext) ImportPrices(ctx context.Context) {
+	dbCtx := context.Background()
+	today := time.Now().UTC().Truncate(time.Hour * 24)
+	var exists bool
+	if err := s.DB.QueryRowContext(dbCtx, `SELECT EXISTS (SELECT 1 FROM prices WHERE day = $1)`, today).Scan(&exists); err != nil {
+		log.Printf("import prices: %+v", err)
+		return
+	}
+	if exists {
+		return
+	}
+	prices, err := readPrices(ctx, s.PricesAddr)
+	if err != nil {
+		log.Printf("import prices: %+v", err)
+		return
+	}
+	var ids []int32
+	var values []float64
+	for id, price := range prices {
+		if _, ok := s.Global.Items[id]; !ok || price <= 0 {
+			continue
+		}
+		ids = append(ids, id)
+		values = append(values, price)
+	}
+	if _, err := s.DB.ExecContext(dbCtx, `
+		UPSERT
+		INTO
+			prices (type, day, price)
+		SELECT
+			type, $3, price
+		FROM
+			ROWS FROM (unnest($1::INT4[]), unnest($2::FLOAT8[])) AS p (type, price)
+	`, pq.Array(ids), pq.Array(values), today); err != nil {
+		log.Printf("import prices: %+v", err)
+		return
+	}
+	fmt.Println("imported", len(ids), "prices")
+}
+
+// PriceFits computes the cost of killmails that don't have one from
+// zkillboard using the prices table.
+func (s *EFContext) PriceFits(ctx context.Context) {
+	dbCtx := context.Background()
+	var exists bool
+	if err := s.DB.QueryRowContext(dbCtx, `SELECT EXISTS (SELECT 1 FROM prices)`).Scan(&exists); err != nil {
+		log.Printf("price fits: %+v", err)
+		return
+	}
+	if !exists {
+		return
+	}
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err := crdb.ExecuteTx(dbCtx, s.DB, nil, s.priceKM); err == sql.ErrNoRows {
+			return
+		} else if err != nil {
+			log.Printf("price fits: %+v", err)
+			return
+		}
+	}
+}
+
+func (s *EFContext) priceKM(tx *sql.Tx) error {
+	var rawKM []byte
+	if err := tx.QueryRow(`
+		SELECT
+			km
+		FROM
+			killmails
+		WHERE
+			processed = $1
+		LIMIT
+			1
+	`, ProcKMFitAdded).Scan(&rawKM); err != nil {
+		return err
+	}
+	var km KM
+	if err := json.Unmarshal(rawKM, &km); err != nil {
+		panic(err)
+	}
+	cost, err := s.Cost(tx, km)
+	if err != nil {
+		return errors.Wrap(err, "cost")
+	}
+	if _, err := tx.Exec(`UPDATE fits SET cost = $2 WHERE killmail = $1`, km.KillmailId, cost); err != nil {
+		return errors.Wrap(err, "update fits")
+	}
+	if _, err := tx.Exec(`UPDATE killmails SET processed = $2 WHERE id = $1`, km.KillmailId, ProcKMCostAdded); err != nil {
+		return errors.Wrap(err, "update killmails")
+	}
+	fmt.Println("priced km", km.KillmailId, "at", cost)
+	return nil
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Prices returns the price of each type on day, or the closest day after
+// it if there's no earlier price. Types without prices are omitted.
+func Prices(q queryer, types []int32, day time.Time) (map[int32]float64, error) {
+	rows, err := q.Query(`
+		SELECT
+			DISTINCT ON (type) type, price
+		FROM
+			prices
+		WHERE
+			type = ANY ($1::INT4[])
+		ORDER BY
+			type,
+			day > $2,
+			-- Later days are only used if there's no earlier price, and
+			-- then the earliest is closest.
+			CASE WHEN day > $2 THEN day END,
+			day DESC
+	`, pq.Array(types), day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	prices := map[int32]float64{}
+	for rows.Next() {
+		var id int32
+		var price float64
+		if err := rows.Scan(&id, &price); err != nil {
+			return nil, err
+		}
+		prices[id] = price
+	}
+	return prices, rows.Err()
+}
+
+// Cost returns the value of km's ship and the modules and charges in its
+// fitting slots at the time of the kill.
+func (s *EFContext) Cost(q queryer, km KM) (int64, error) {
+	quantities := km.Quantities()
+	types := make([]int32, 0, len(quantities))
+	for id := range quantities {
+		types = append(types, id)
+	}
+	prices, err := Prices(q, types, km.KillmailTime)
+	if err != nil {
+		return 0, err
+	}
+	var cost float64
+	for id, n := range quantities {
+		cost += prices[id] * float64(n)
+	}
+	return int64(cost), nil
+}
+
+// Quantities returns the number of each type of the ship and the items in
+// its fitting slots, including charges.
+func (k KM) Quantities() map[int32]int64 {
+	quantities := map[int32]int64{
+		k.Victim.ShipTypeId: 1,
+	}
+	for _, i := range k.Victim.Items {
+		if Slot(i.Flag).Type() == "" {
+			continue
+		}
+		quantities[i.ItemTypeId] += KMItem(i).Quantity()
+	}
+	return quantities
+}
+
+// Hubs are the trade hubs with market prices, mapped to the station and
+// region IDs of their prices in aggregate sources.
+var Hubs = map[string][]int64{
+	"jita":    {60003760, 10000002},
+	"amarr":   {60008494, 10000043},
+	"dodixie": {60011866, 10000032},
+	"rens":    {60004588, 10000030},
+	"hek":     {60005686, 10000042},
+}
+
+// HubPrice is the buy and sell price of a type at a hub.
+type HubPrice struct {
+	Buy, Sell float64
+}
+
+// readHubPrices reads hub prices from addr, a Fuzzwork-style aggregate CSV
+// (optionally gzipped) with a header and rows of what,...,fivepercent,...
+// where what is location|type|isbuy. The fivepercent column, the average
+// of the best 5% of orders, is used as the price.
+func readHubPrices(ctx context.Context, addr string) (map[string]map[int32]HubPrice, error) {
+	rc, err := openSource(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if strings.HasSuffix(addr, ".gz") {
+		gz, err := gzip.NewReader(rc)
+		if err != nil {
+			return nil, errors.Wrap(err, "gzip")
+		}
+		defer gz.Close()
+		r = gz
+	}
+	// Map locations to hubs, preferring station prices over region
+	// prices.
+	type hubLoc struct {
+		hub  string
+		rank int
+	}
+	locs := map[int64]hubLoc{}
+	for hub, ids := range Hubs {
+		for i, id := range ids {
+			locs[id] = hubLoc{hub, i}
+		}
+	}
+	type key struct {
+		hub  string
+		typ  int32
+		rank int
+	}
+	found := map[key]HubPrice{}
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "csv header")
+	}
+	whatCol, priceCol := -1, -1
+	for i, h := range header {
+		switch strings.ToLower(h) {
+		case "what":
+			whatCol = i
+		case "fivepercent":
+			priceCol = i
+		}
+	}
+	if whatCol < 0 || priceCol < 0 {
+		return nil, errors.New("csv missing what or fivepercent column")
+	}
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "csv")
+		}
+		what := strings.Split(rec[whatCol], "|")
+		if len(what) != 3 {
+			continue
+		}
+		loc, _ := strconv.ParseInt(what[0], 10, 64)
+		hl, ok := locs[loc]
+		if !ok {
+			continue
+		}
+		typ, _ := strconv.Atoi(what[1])
+		buy, _ := strconv.ParseBool(what[2])
+		price, _ := strconv.ParseFloat(rec[priceCol], 64)
+		k := key{hl.hub, int32(typ), hl.rank}
+		p := found[k]
+		if buy {
+			p.Buy = price
+		} else {
+			p.Sell = price
+		}
+		found[k] = p
+	}
+	prices := map[string]map[int32]HubPrice{}
+	ranks := map[key]int{}
+	for k, p := range found {
+		if prices[k.hub] == nil {
+			prices[k.hub] = map[int32]HubPrice{}
+		}
+		rk := key{hub: k.hub, typ: k.typ}
+		if r, ok := ranks[rk]; ok && r < k.rank {
+			continue
+		}
+		ranks[rk] = k.rank
+		prices[k.hub][k.typ] = p
+	}
+	return prices, nil
+}
+
+// ImportHubPrices imports hub prices if they haven't been today.
+func (s *EFContext) ImportHubPrices(ctx context.Context) {
+	if s.HubPricesAddr == "" {
+		return
+	}
+	dbCtx := context.Background()
+	today := time.Now().UTC().Truncate(time.Hour * 24)
+	var exists bool
+	if err := s.DB.QueryRowContext(dbCtx, `SELECT EXISTS (SELECT 1 FROM hub_prices WHERE updated >= $1)`, today).Scan(&exists); err != nil {
+		log.Printf("import hub prices: %+v", err)
+		return
+	}
+	if exists {
+		return
+	}
+	prices, err := readHubPrices(ctx, s.HubPricesAddr)
+	if err != nil {
+		log.Printf("import hub prices: %+v", err)
+		return
+	}
+	for hub, hp := range prices {
+		var ids []int32
+		var buys, sells []float64
+		for id, p := range hp {
+			if _, ok := s.Global.Items[id]; !ok {
+				continue
+			}
+			ids = append(ids, id)
+			buys = append(buys, p.Buy)
+			sells = append(sells, p.Sell)
+		}
+		if _, err := s.DB.ExecContext(dbCtx, `
+			UPSERT
+			INTO
+				hub_prices (hub, type, buy, sell, updated)
+			SELECT
+				$1, type, buy, sell, now()
+			FROM
+				ROWS FROM (
+					unnest($2::INT4[]),
+					unnest($3::FLOAT8[]),
+					unnest($4::FLOAT8[])
+				)
+					AS p (type, buy, sell)
+		`, hub, pq.Array(ids), pq.Array(buys), pq.Array(sells)); err != nil {
+			log.Printf("import hub prices: %+v", err)
+			return
+		}
+		fmt.Println("imported", len(ids), "prices for", hub)
+	}
+}
+
+// HubPrices returns the prices of types at hub. Types without prices are
+// omitted.
+func HubPrices(ctx context.Context, db *sql.DB, hub string, types []int32) (map[int32]HubPrice, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT
+			type, buy, sell
+		FROM
+			hub_prices
+		WHERE
+			hub = $1 AND type = ANY ($2::INT4[])
+	`, hub, pq.Array(types))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	prices := map[int32]HubPrice{}
+	for rows.Next() {
+		var id int32
+		var p HubPrice
+		if err := rows.Scan(&id, &p.Buy, &p.Sell); err != nil {
+			return nil, err
+		}
+		prices[id] = p
+	}
+	return prices, rows.Err()
+}
+
+// parseHub returns the hub named by the hub form value, or "" if none was
+// requested.
+func parseHub(r *http.Request) (string, error) {
+	hub := strings.ToLower(r.FormValue("hub"))
+	if hub == "" {
+		return "", nil
+	}
+	if _, ok := Hubs[hub]; !ok {
+		return "", errors.Errorf("unknown hub: %s", hub)
+	}
+	return hub, nil
+}
+
+// PricedItem is the quantity and total price of a type at a hub.
+type PricedItem struct {
+	Item
+	Quantity int64
+	HubPrice
+}
+
+// SlotPrice is the priced contents of a slot type.
+type SlotPrice struct {
+	Items []PricedItem
+	HubPrice
+}
+
+// PriceBreakdown is the price of a fit at a hub per slot type. The ship
+// is in the ship slot.
+type PriceBreakdown struct {
+	Hub   string
+	Slots map[string]*SlotPrice
+	HubPrice
+}
+
+// HubBreakdown prices km's ship and the modules and charges in its fitting
+// slots at hub.
+func (s *EFContext) HubBreakdown(ctx context.Context, hub string, km KM) (*PriceBreakdown, error) {
+	bs, err := s.HubBreakdowns(ctx, hub, []KM{km})
+	if err != nil {
+		return nil, err
+	}
+	return bs[0], nil
+}
+
+// HubBreakdowns is HubBreakdown for many killmails with one price lookup.
+func (s *EFContext) HubBreakdowns(ctx context.Context, hub string, kms []KM) ([]*PriceBreakdown, error) {
+	type key struct {
+		slot string
+		typ  int32
+	}
+	quantities := make([]map[key]int64, len(kms))
+	var types []int32
+	for i, km := range kms {
+		quantities[i] = map[key]int64{
+			{StatSlotShip, km.Victim.ShipTypeId}: 1,
+		}
+		types = append(types, km.Victim.ShipTypeId)
+		for _, item := range km.Victim.Items {
+			slot := Slot(item.Flag).Type()
+			if slot == "" {
+				continue
+			}
+			quantities[i][key{slot, item.ItemTypeId}] += KMItem(item).Quantity()
+			types = append(types, item.ItemTypeId)
+		}
+	}
+	prices, err := HubPrices(ctx, s.DB, hub, types)
+	if err != nil {
+		return nil, err
+	}
+	bs := make([]*PriceBreakdown, len(kms))
+	for i := range kms {
+		b := &PriceBreakdown{
+			Hub:   hub,
+			Slots: map[string]*SlotPrice{},
+		}
+		for k, n := range quantities[i] {
+			p := prices[k.typ]
+			item := PricedItem{
+				Item:     s.Global.Items[k.typ],
+				Quantity: n,
+				HubPrice: HubPrice{
+					Buy:  p.Buy * float64(n),
+					Sell: p.Sell * float64(n),
+				},
+			}
+			item.ID = k.typ
+			sp := b.Slots[k.slot]
+			if sp == nil {
+				sp = &SlotPrice{}
+				b.Slots[k.slot] = sp
+			}
+			sp.Items = append(sp.Items, item)
+			sp.Buy += item.Buy
+			sp.Sell += item.Sell
+			b.Buy += item.Buy
+			b.Sell += item.Sell
+		}
+		for _, sp := range b.Slots {
+			sort.Slice(sp.Items, func(i, j int) bool {
+				return sp.Items[i].Sell > sp.Items[j].Sell
+			})
+		}
+		bs[i] = b
+	}
+	return bs, nil
+}
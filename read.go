@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/antihax/goesi/esi"
@@ -14,6 +17,7 @@ import (
 	"github.com/pkg/errors"
 )
 
+// CreateTables drops and recreates all tables.
 func (s *EFContext) CreateTables() {
 	if _, err := s.DB.Exec(`
 		DROP TABLE IF EXISTS hashes;
@@ -22,38 +26,288 @@ func (s *EFContext) CreateTables() {
 
 		DROP TABLE IF EXISTS killmails;
 
-		CREATE TABLE hashes (
-			id        INT4 PRIMARY KEY,
-			hash      STRING NOT NULL,
-			processed INT4 DEFAULT 0 NOT NULL,
-			INDEX (processed)
-		);
-
-		CREATE TABLE killmails (
-			id        INT4 PRIMARY KEY,
-			km        JSONB NOT NULL,
-			zkb JSONB NOT NULL,
-			processed INT4 DEFAULT 0 NOT NULL,
-			INDEX (processed)
-		);
-
-		CREATE TABLE fits (
-			killmail    INT4,
-			ship        INT4 NOT NULL,
-			cost        INT8,
-			solarsystem INT4 NOT NULL,
-			hi          JSONB NOT NULL,
-			med         JSONB NOT NULL,
-			low         JSONB NOT NULL,
-			rig         JSONB NOT NULL,
-			sub         JSONB NOT NULL,
-			items       JSONB NOT NULL,
-			PRIMARY KEY (killmail DESC),
-			INVERTED INDEX (items)
-		);
+		DROP TABLE IF EXISTS ship_stats;
+
+		DROP TABLE IF EXISTS trends;
+
+		DROP TABLE IF EXISTS trend_days;
+
+		DROP TABLE IF EXISTS names;
+
+		DROP TABLE IF EXISTS prices;
+
+		DROP TABLE IF EXISTS hub_prices;
+
+		DROP TABLE IF EXISTS collection_fits;
+
+		DROP TABLE IF EXISTS collections;
+
+		DROP TABLE IF EXISTS doctrines;
+
+		DROP TABLE IF EXISTS sso_states;
+
+		DROP TABLE IF EXISTS sessions;
 	`); err != nil {
 		log.Fatal(err)
 	}
+	s.Migrate()
+}
+
+// schema creates the tables that don't exist. The indexes of fits are in
+// fitsIndexes so they can be added to existing tables.
+const schema = `
+	CREATE TABLE IF NOT EXISTS hashes (
+		id        INT4 PRIMARY KEY,
+		hash      STRING NOT NULL,
+		processed INT4 DEFAULT 0 NOT NULL,
+		INDEX (processed)
+	);
+
+	CREATE TABLE IF NOT EXISTS killmails (
+		id        INT4 PRIMARY KEY,
+		km        JSONB NOT NULL,
+		zkb JSONB NOT NULL,
+		processed INT4 DEFAULT 0 NOT NULL,
+		INDEX (processed)
+	);
+
+	CREATE TABLE IF NOT EXISTS fits (
+		killmail    INT4,
+		ship        INT4 NOT NULL,
+		cost        INT8,
+		solarsystem INT4 NOT NULL,
+		hi          JSONB NOT NULL,
+		med         JSONB NOT NULL,
+		low         JSONB NOT NULL,
+		rig         JSONB NOT NULL,
+		sub         JSONB NOT NULL,
+		items       JSONB NOT NULL,
+		groups      JSONB NOT NULL,
+		categories  JSONB NOT NULL,
+		counts      JSONB NOT NULL,
+		killtime    TIMESTAMPTZ NOT NULL,
+		fingerprint STRING NOT NULL,
+		valid       BOOL NOT NULL,
+		violations  JSONB NOT NULL,
+		character   INT4,
+		corporation INT4,
+		alliance    INT4,
+		attackers   INT4 NOT NULL,
+		attacker_ships JSONB NOT NULL,
+		attacker_weapons JSONB NOT NULL,
+		engagement  STRING NOT NULL,
+		solo        BOOL NOT NULL,
+		npc         BOOL NOT NULL,
+		awox        BOOL NOT NULL,
+		PRIMARY KEY (killmail DESC)
+	);
+
+	CREATE TABLE IF NOT EXISTS ship_stats (
+		ship  INT4,
+		day   DATE,
+		slot  STRING,
+		item  INT4,
+		fits  INT8 NOT NULL,
+		count INT8 NOT NULL,
+		PRIMARY KEY (ship, day, slot, item)
+	);
+
+	CREATE TABLE IF NOT EXISTS trends (
+		kind  STRING,
+		type  INT4,
+		day   DATE,
+		count INT8 NOT NULL,
+		PRIMARY KEY (kind, type, day),
+		INDEX (day)
+	);
+
+	CREATE TABLE IF NOT EXISTS trend_days (
+		day DATE PRIMARY KEY
+	);
+
+	CREATE TABLE IF NOT EXISTS names (
+		id       INT4 PRIMARY KEY,
+		category STRING NOT NULL,
+		name     STRING NOT NULL,
+		updated  TIMESTAMPTZ NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS prices (
+		type  INT4,
+		day   DATE,
+		price FLOAT8 NOT NULL,
+		PRIMARY KEY (type, day DESC)
+	);
+
+	CREATE TABLE IF NOT EXISTS hub_prices (
+		hub     STRING,
+		type    INT4,
+		buy     FLOAT8 NOT NULL,
+		sell    FLOAT8 NOT NULL,
+		updated TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (hub, type)
+	);
+
+	CREATE TABLE IF NOT EXISTS collections (
+		id      STRING PRIMARY KEY,
+		key     STRING NOT NULL,
+		name    STRING NOT NULL,
+		owner   INT4,
+		created TIMESTAMPTZ NOT NULL,
+		INDEX (owner)
+	);
+
+	CREATE TABLE IF NOT EXISTS collection_fits (
+		collection STRING REFERENCES collections (id) ON DELETE CASCADE,
+		killmail   INT4,
+		note       STRING NOT NULL,
+		added      TIMESTAMPTZ NOT NULL,
+		PRIMARY KEY (collection, killmail)
+	);
+
+	CREATE TABLE IF NOT EXISTS doctrines (
+		id          STRING PRIMARY KEY,
+		key         STRING NOT NULL,
+		name        STRING NOT NULL,
+		owner       INT4,
+		ship        INT4 NOT NULL,
+		eft         STRING NOT NULL,
+		modules     JSONB NOT NULL,
+		corporation INT4,
+		alliance    INT4,
+		created     TIMESTAMPTZ NOT NULL,
+		INDEX (owner)
+	);
+
+	CREATE TABLE IF NOT EXISTS sso_states (
+		state    STRING PRIMARY KEY,
+		verifier STRING NOT NULL,
+		created  TIMESTAMPTZ NOT NULL,
+		INDEX (created)
+	);
+
+	CREATE TABLE IF NOT EXISTS sessions (
+		id            STRING PRIMARY KEY,
+		character     INT4 NOT NULL,
+		name          STRING NOT NULL,
+		access_token  STRING NOT NULL,
+		refresh_token STRING NOT NULL,
+		token_expires TIMESTAMPTZ NOT NULL,
+		created       TIMESTAMPTZ NOT NULL,
+		INDEX (created)
+	);
+`
+
+// fitsColumns are the columns added to fits since it was first released,
+// with defaults for existing rows. Existing fits are reprocessed to fill
+// them in.
+var fitsColumns = []struct {
+	name, def string
+}{
+	{"groups", `JSONB NOT NULL DEFAULT '[]'`},
+	{"categories", `JSONB NOT NULL DEFAULT '[]'`},
+	{"counts", `JSONB NOT NULL DEFAULT '{}'`},
+	{"killtime", `TIMESTAMPTZ NOT NULL DEFAULT '1970-01-01'`},
+	{"fingerprint", `STRING NOT NULL DEFAULT ''`},
+	{"valid", `BOOL NOT NULL DEFAULT false`},
+	{"violations", `JSONB NOT NULL DEFAULT '[]'`},
+	{"character", `INT4`},
+	{"corporation", `INT4`},
+	{"alliance", `INT4`},
+	{"attackers", `INT4 NOT NULL DEFAULT 0`},
+	{"attacker_ships", `JSONB NOT NULL DEFAULT '[]'`},
+	{"attacker_weapons", `JSONB NOT NULL DEFAULT '[]'`},
+	{"engagement", `STRING NOT NULL DEFAULT ''`},
+	{"solo", `BOOL NOT NULL DEFAULT false`},
+	{"npc", `BOOL NOT NULL DEFAULT false`},
+	{"awox", `BOOL NOT NULL DEFAULT false`},
+}
+
+// fitsIndexes are the secondary indexes of fits. They are named because
+// queries use them in index hints.
+var fitsIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS fits_solarsystem_idx ON fits (solarsystem)`,
+	`CREATE INDEX IF NOT EXISTS fits_corporation_idx ON fits (corporation)`,
+	`CREATE INDEX IF NOT EXISTS fits_alliance_idx ON fits (alliance)`,
+	`CREATE INDEX IF NOT EXISTS fits_ship_fingerprint_idx ON fits (ship, fingerprint) STORING (cost, killtime)`,
+	`CREATE INDEX IF NOT EXISTS fits_fingerprint_idx ON fits (fingerprint)`,
+	`CREATE INDEX IF NOT EXISTS fits_ship_killmail_idx ON fits (ship, killmail DESC) STORING (attacker_ships, attacker_weapons)`,
+	`CREATE INDEX IF NOT EXISTS fits_killtime_idx ON fits (killtime) STORING (ship, items)`,
+	`CREATE INVERTED INDEX IF NOT EXISTS fits_items_idx ON fits (items)`,
+	`CREATE INVERTED INDEX IF NOT EXISTS fits_groups_idx ON fits (groups)`,
+	`CREATE INVERTED INDEX IF NOT EXISTS fits_categories_idx ON fits (categories)`,
+}
+
+// reprocessKey is a config key that is set while existing fits are being
+// reprocessed, so that an interrupted reprocess is resumed.
+const reprocessKey = "reprocess-fits"
+
+// Migrate creates missing tables, columns, and indexes. It is safe to run
+// on every start. If columns were added to fits, all fits are deleted and
+// their killmails processed again, along with the stats derived from them.
+func (s *EFContext) Migrate() {
+	if _, err := s.DB.Exec(schema); err != nil {
+		log.Fatal(err)
+	}
+	existing := map[string]bool{}
+	rows, err := s.DB.Query(`SELECT column_name FROM information_schema.columns WHERE table_name = 'fits'`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			log.Fatal(err)
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	for _, c := range fitsColumns {
+		if existing[c.name] {
+			continue
+		}
+		if _, err := s.DB.Exec(`UPSERT INTO config (key, val) VALUES ($1, '')`, reprocessKey); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("adding column fits.", c.name)
+		if _, err := s.DB.Exec(`ALTER TABLE fits ADD COLUMN IF NOT EXISTS ` + c.name + ` ` + c.def); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, stmt := range fitsIndexes {
+		if _, err := s.DB.Exec(stmt); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var reprocess bool
+	if err := s.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM config WHERE key = $1)`, reprocessKey).Scan(&reprocess); err != nil {
+		log.Fatal(err)
+	}
+	if !reprocess {
+		return
+	}
+	// Batched so no transaction gets too large.
+	for _, stmt := range []string{
+		`DELETE FROM fits WHERE true LIMIT 10000`,
+		`DELETE FROM ship_stats WHERE true LIMIT 10000`,
+		`DELETE FROM trends WHERE true LIMIT 10000`,
+		`UPDATE killmails SET processed = 0 WHERE processed != 0 LIMIT 10000`,
+	} {
+		for {
+			res, err := s.DB.Exec(stmt)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				break
+			}
+		}
+		fmt.Println("reprocess:", stmt)
+	}
+	if _, err := s.DB.Exec(`DELETE FROM config WHERE key = $1`, reprocessKey); err != nil {
+		log.Fatal(err)
+	}
 }
 
 const (
@@ -66,6 +320,19 @@ const (
 
 type KM esi.GetKillmailsKillmailIdKillmailHashOk
 
+// KMItem is an item of a killmail's victim.
+type KMItem esi.GetKillmailsKillmailIdKillmailHashItem
+
+// Quantity returns the number of the item, destroyed or dropped. Fitted
+// modules have no quantity and count as one.
+func (i KMItem) Quantity() int64 {
+	n := i.QuantityDestroyed + i.QuantityDropped
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
 type Slot int32
 
 const (
@@ -117,6 +384,12 @@ const (
 	SubSlot7
 )
 
+// Item locations outside of fitting slots.
+const (
+	SlotCargo    Slot = 5
+	SlotDroneBay Slot = 87
+)
+
 func IsHigh(s Slot) bool   { return s.IsHigh() }
 func IsMedium(s Slot) bool { return s.IsMedium() }
 func IsLow(s Slot) bool    { return s.IsLow() }
@@ -143,6 +416,24 @@ func (s Slot) IsSub() bool {
 	return s >= SubSlot0 && s <= SubSlot7
 }
 
+// Type returns the name of the slot type of s from SlotTypes, or "" if s
+// isn't a fitting slot.
+func (s Slot) Type() string {
+	switch {
+	case s.IsHigh():
+		return "hi"
+	case s.IsMedium():
+		return "med"
+	case s.IsLow():
+		return "low"
+	case s.IsRig():
+		return "rig"
+	case s.IsSub():
+		return "sub"
+	}
+	return ""
+}
+
 // FetchHashes listens on the zkillboard redisq API and populates the hashes
 // and killmails tables with results. As soon as zkillboard has no more results
 // or ctx is cancelled this function returns.
@@ -215,11 +506,15 @@ type ZKillPackage struct {
 		KillID   int `json:"killID"`
 		Killmail struct {
 			Attackers []struct {
-				CorporationID  int  `json:"corporation_id"`
-				DamageDone     int  `json:"damage_done"`
-				FinalBlow      bool `json:"final_blow"`
-				SecurityStatus int  `json:"security_status"`
-				ShipTypeID     int  `json:"ship_type_id"`
+				AllianceID     int     `json:"alliance_id,omitempty"`
+				CharacterID    int     `json:"character_id,omitempty"`
+				CorporationID  int     `json:"corporation_id"`
+				DamageDone     int     `json:"damage_done"`
+				FactionID      int     `json:"faction_id,omitempty"`
+				FinalBlow      bool    `json:"final_blow"`
+				SecurityStatus float64 `json:"security_status"`
+				ShipTypeID     int     `json:"ship_type_id"`
+				WeaponTypeID   int     `json:"weapon_type_id,omitempty"`
 			} `json:"attackers"`
 			KillmailID    int       `json:"killmail_id"`
 			KillmailTime  time.Time `json:"killmail_time"`
@@ -248,6 +543,29 @@ type ZKillPackage struct {
 	} `json:"package"`
 }
 
+// Engagement sizes.
+const (
+	EngagementSolo  = "solo"
+	EngagementSmall = "small"
+	EngagementFleet = "fleet"
+)
+
+// smallGangAttackers is the most attackers a small gang engagement can
+// have.
+const smallGangAttackers = 10
+
+// Engagement returns the engagement size of a kill with attackers.
+func Engagement(attackers int, solo bool) string {
+	switch {
+	case solo || attackers <= 1:
+		return EngagementSolo
+	case attackers <= smallGangAttackers:
+		return EngagementSmall
+	default:
+		return EngagementFleet
+	}
+}
+
 type Zkb struct {
 	LocationID  int     `json:"locationID"`
 	Hash        string  `json:"hash"`
@@ -328,8 +646,76 @@ func (s *EFContext) processKM(tx *sql.Tx) error {
 		}
 		args = append(args, enc)
 		args = append(args, int64(zkb.FittedValue))
+		// Store the distinct groups and categories of all items so group
+		// filters don't have to match against every item in a group.
+		var groups, categories []int32
+		seenGroups := map[int32]bool{}
+		seenCategories := map[int32]bool{}
+		for _, id := range items {
+			item, ok := s.Global.Items[id]
+			if !ok || seenGroups[item.Group] {
+				continue
+			}
+			seenGroups[item.Group] = true
+			groups = append(groups, item.Group)
+			cat := s.Global.Groups[item.Group].Category
+			if !seenCategories[cat] {
+				seenCategories[cat] = true
+				categories = append(categories, cat)
+			}
+		}
+		for _, v := range [][]int32{groups, categories} {
+			enc, err := json.Marshal(&v)
+			if err != nil {
+				panic(err)
+			}
+			args = append(args, enc)
+		}
+		// Count the number of slots each type is in so fits can be
+		// filtered by, say, at least 3 of some module.
+		counts := map[int32]int{}
+		for _, id := range items {
+			counts[id]++
+		}
+		enc, err = json.Marshal(&counts)
+		if err != nil {
+			panic(err)
+		}
+		args = append(args, enc)
+		args = append(args, km.KillmailTime, km.Fingerprint(s))
+		// CPU and powergrid warnings don't make a fit invalid.
+		violations, _ := km.Validate(s)
+		enc, err = json.Marshal(&violations)
+		if err != nil {
+			panic(err)
+		}
+		args = append(args, len(violations) == 0, enc)
+		// Empty, not nil, so the columns are JSON arrays.
+		attackerShips, attackerWeapons := []int32{}, []int32{}
+		for _, a := range km.Attackers {
+			if a.ShipTypeId > 0 {
+				attackerShips = append(attackerShips, a.ShipTypeId)
+			}
+			if a.WeaponTypeId > 0 {
+				attackerWeapons = append(attackerWeapons, a.WeaponTypeId)
+			}
+		}
+		args = append(args,
+			nullInt32(v.CharacterId),
+			nullInt32(v.CorporationId),
+			nullInt32(v.AllianceId),
+			len(km.Attackers),
+		)
+		for _, v := range [][]int32{attackerShips, attackerWeapons} {
+			enc, err := json.Marshal(&v)
+			if err != nil {
+				panic(err)
+			}
+			args = append(args, enc)
+		}
+		args = append(args, Engagement(len(km.Attackers), zkb.Solo), zkb.Solo, zkb.Npc, zkb.Awox)
 
-		if _, err := tx.Exec(`
+		if err := tx.QueryRow(`
 			INSERT
 			INTO
 				fits
@@ -343,16 +729,44 @@ func (s *EFContext) processKM(tx *sql.Tx) error {
 						rig,
 						sub,
 						items,
-						cost
+						cost,
+						groups,
+						categories,
+						counts,
+						killtime,
+						fingerprint,
+						valid,
+						violations,
+						character,
+						corporation,
+						alliance,
+						attackers,
+						attacker_ships,
+						attacker_weapons,
+						engagement,
+						solo,
+						npc,
+						awox
 					)
 			VALUES
-				($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+				(
+					$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14,
+					$15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27
+				)
 			ON CONFLICT
 				(killmail)
 			DO
 				NOTHING
-		`, args...); err != nil {
+			RETURNING
+				killmail
+		`, args...).Scan(new(int32)); err == sql.ErrNoRows {
+			// Already inserted, don't count it in the stats again.
+		} else if err != nil {
 			return errors.Wrap(err, "upsert")
+		} else if err := s.addShipStats(tx, km); err != nil {
+			return errors.Wrap(err, "ship stats")
+		} else if _, err := tx.Exec(`UPSERT INTO trend_days (day) VALUES ($1)`, km.KillmailTime.UTC().Format("2006-01-02")); err != nil {
+			return errors.Wrap(err, "trend days")
 		}
 	}
 	proc := ProcKMFitAdded
@@ -367,6 +781,11 @@ func (s *EFContext) processKM(tx *sql.Tx) error {
 	return nil
 }
 
+// nullInt32 returns a NULL for 0 IDs, which ESI omits.
+func nullInt32(v int32) sql.NullInt32 {
+	return sql.NullInt32{Int32: v, Valid: v != 0}
+}
+
 func (k KM) Items(s *EFContext) (hi, med, low, rig, sub [8]ItemCharge, items []int32) {
 	items = append(items, k.Victim.ShipTypeId)
 	for _, i := range k.Victim.Items {
@@ -405,6 +824,126 @@ func (k KM) Items(s *EFContext) (hi, med, low, rig, sub [8]ItemCharge, items []i
 	return
 }
 
+// Fingerprint returns an identifier of the ship and its fitted modules,
+// ignoring charges and the order of modules within a slot type. Fits with
+// the same fingerprint are identical.
+func (k KM) Fingerprint(s *EFContext) string {
+	h := sha1.New()
+	fmt.Fprintln(h, k.Victim.ShipTypeId)
+	for _, ids := range k.Modules(s) {
+		sorted := append([]int32(nil), ids...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		fmt.Fprintln(h, sorted)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Modules returns the fitted modules of k.
+func (k KM) Modules(s *EFContext) Modules {
+	hi, med, low, rig, sub, _ := k.Items(s)
+	var m Modules
+	for i, slots := range [][8]ItemCharge{hi, med, low, rig, sub} {
+		for _, ic := range slots {
+			if ic.ID > 0 {
+				m[i] = append(m[i], ic.ID)
+			}
+		}
+	}
+	return m
+}
+
+// SlotTypes are the names of the slot types in the order they are indexed
+// in Modules.
+var SlotTypes = [...]string{"hi", "med", "low", "rig", "sub"}
+
+// Modules holds the type IDs of the modules (not charges) in each slot
+// type, indexed in SlotTypes order.
+type Modules [len(SlotTypes)][]int32
+
+// Similarity returns the weighted Jaccard index of the slot-aware module
+// multisets of m and o: 1 if they are identical and 0 if they share
+// nothing.
+func (m Modules) Similarity(o Modules) float64 {
+	var min, max int
+	for i := range m {
+		a := map[int32]int{}
+		for _, id := range m[i] {
+			a[id]++
+		}
+		b := map[int32]int{}
+		for _, id := range o[i] {
+			b[id]++
+		}
+		for id, n := range a {
+			if b[id] < n {
+				min += b[id]
+				max += n
+			} else {
+				min += n
+				max += b[id]
+			}
+		}
+		for id, n := range b {
+			if _, ok := a[id]; !ok {
+				max += n
+			}
+		}
+	}
+	if max == 0 {
+		return 1
+	}
+	return float64(min) / float64(max)
+}
+
+// ModulesDiff holds, for each slot type indexed in SlotTypes order, the
+// type IDs of modules missing from and extra to a fit compared to another.
+type ModulesDiff struct {
+	Missing, Extra Modules
+}
+
+// Diff returns the modules of m missing from o and the modules of o extra
+// to m, counting duplicates.
+func (m Modules) Diff(o Modules) ModulesDiff {
+	var d ModulesDiff
+	for i := range m {
+		d.Missing[i], d.Extra[i] = diffIDs(m[i], o[i])
+	}
+	return d
+}
+
+// diffIDs returns the IDs of a not in b and of b not in a, treating both
+// as multisets.
+func diffIDs(a, b []int32) (missing, extra []int32) {
+	have := map[int32]int{}
+	for _, id := range b {
+		have[id]++
+	}
+	for _, id := range a {
+		if have[id] > 0 {
+			have[id]--
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	for _, id := range b {
+		if have[id] > 0 {
+			have[id]--
+			extra = append(extra, id)
+		}
+	}
+	return missing, extra
+}
+
+// Empty reports whether there are no differences.
+func (d ModulesDiff) Empty() bool {
+	for i := range d.Missing {
+		if len(d.Missing[i]) > 0 || len(d.Extra[i]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
 type ItemCharge struct {
 	Item
 	Charge *Item `json:",omitempty"`
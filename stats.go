@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	servertiming "github.com/mitchellh/go-server-timing"
+	"github.com/pkg/errors"
+)
+
+// Slots of ship_stats in addition to the SlotTypes. The ship slot counts
+// the number of fits of the ship.
+const (
+	StatSlotShip   = "ship"
+	StatSlotCharge = "charge"
+)
+
+// addShipStats adds the modules and charges of km to the daily ship_stats
+// aggregates.
+func (s *EFContext) addShipStats(tx *sql.Tx, km KM) error {
+	type key struct {
+		slot string
+		item int32
+	}
+	counts := map[key]int{
+		{StatSlotShip, km.Victim.ShipTypeId}: 1,
+	}
+	hi, med, low, rig, sub, _ := km.Items(s)
+	for i, slots := range [][8]ItemCharge{hi, med, low, rig, sub} {
+		for _, ic := range slots {
+			if ic.ID > 0 {
+				counts[key{SlotTypes[i], ic.ID}]++
+			}
+			if ic.Charge != nil {
+				counts[key{StatSlotCharge, ic.Charge.ID}]++
+			}
+		}
+	}
+
+	day := km.KillmailTime.UTC().Truncate(time.Hour * 24)
+	var sb strings.Builder
+	var args []interface{}
+	for k, n := range counts {
+		if len(args) > 0 {
+			sb.WriteString(", ")
+		}
+		args = append(args, km.Victim.ShipTypeId, day, k.slot, k.item, n)
+		i := len(args)
+		fmt.Fprintf(&sb, "($%d, $%d, $%d, $%d, 1, $%d)", i-4, i-3, i-2, i-1, i)
+	}
+	_, err := tx.Exec(`
+		INSERT
+		INTO
+			ship_stats (ship, day, slot, item, fits, count)
+		VALUES
+			`+sb.String()+`
+		ON CONFLICT
+			(ship, day, slot, item)
+		DO
+			UPDATE SET
+				fits = ship_stats.fits + excluded.fits,
+				count = ship_stats.count + excluded.count
+	`, args...)
+	return err
+}
+
+// ShipStats returns the most used modules per slot type, rigs and charges
+// of a ship.
+func (s *EFContext) ShipStats(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	ship, _ := strconv.Atoi(r.FormValue("ship"))
+	if ship <= 0 {
+		return nil, errors.New("missing ship")
+	}
+	// days of 0 means all time.
+	days, _ := strconv.Atoi(r.FormValue("days"))
+	var since time.Time
+	if days > 0 {
+		since = time.Now().UTC().AddDate(0, 0, -days)
+	}
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 10
+	}
+
+	type Stat struct {
+		Item
+		// Fits is the number of fits with the item in the slot type.
+		Fits int64
+		// Count is the total number of slots the item was in.
+		Count int64
+		// Percent is the percentage of fits with the item in the slot
+		// type.
+		Percent float64
+	}
+	var ret struct {
+		Ship  Item
+		Days  int
+		Fits  int64
+		Slots map[string][]Stat
+	}
+	ret.Ship = s.Global.Items[int32(ship)]
+	ret.Days = days
+	ret.Slots = map[string][]Stat{}
+
+	var rows []struct {
+		Slot  string
+		Item  int32
+		Fits  int64
+		Count int64
+	}
+	selectT := timing.NewMetric("select").Start()
+	err := s.X.SelectContext(ctx, &rows, `
+		SELECT
+			slot, item, sum(fits)::INT8 AS fits, sum(count)::INT8 AS count
+		FROM
+			ship_stats
+		WHERE
+			ship = $1 AND day >= $2
+		GROUP BY
+			slot, item
+	`, ship, since)
+	selectT.Stop()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		if row.Slot == StatSlotShip {
+			ret.Fits += row.Fits
+			continue
+		}
+		ret.Slots[row.Slot] = append(ret.Slots[row.Slot], Stat{
+			Item:  s.Global.Items[row.Item],
+			Fits:  row.Fits,
+			Count: row.Count,
+		})
+	}
+	for slot, stats := range ret.Slots {
+		sort.Slice(stats, func(i, j int) bool {
+			if stats[i].Fits != stats[j].Fits {
+				return stats[i].Fits > stats[j].Fits
+			}
+			return stats[i].Count > stats[j].Count
+		})
+		if len(stats) > limit {
+			stats = stats[:limit]
+		}
+		for i := range stats {
+			if ret.Fits > 0 {
+				stats[i].Percent = float64(stats[i].Fits) * 100 / float64(ret.Fits)
+			}
+		}
+		ret.Slots[slot] = stats
+	}
+	return ret, nil
+}
+
+// CoFitted returns the items most often fitted with item on ship. Lift is
+// how much more likely an item is to be fitted when item is also fitted:
+// values above 1 mean they are fitted together more often than chance.
+func (s *EFContext) CoFitted(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	ship, _ := strconv.Atoi(r.FormValue("ship"))
+	if ship <= 0 {
+		return nil, errors.New("missing ship")
+	}
+	item, _ := strconv.Atoi(r.FormValue("item"))
+	if item <= 0 {
+		return nil, errors.New("missing item")
+	}
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	// Only the most recent fits are sampled to bound the query time.
+	const sample = 5000
+
+	type CoItem struct {
+		Item
+		// Fits is the number of sampled fits with both items.
+		Fits int64
+		// Percent is the percentage of sampled fits with item that
+		// also have this item.
+		Percent float64
+		Lift    float64
+	}
+	var ret struct {
+		Ship Item
+		Item Item
+		// Fits is the number of sampled fits of the ship.
+		Fits int64
+		// ItemFits is the number of sampled fits with item.
+		ItemFits int64
+		Items    []CoItem
+	}
+	ret.Ship = s.Global.Items[int32(ship)]
+	ret.Item = s.Global.Items[int32(item)]
+
+	var rows []struct {
+		Item   int32
+		Fits   int64
+		CoFits int64
+	}
+	selectT := timing.NewMetric("select").Start()
+	err := s.X.SelectContext(ctx, &rows, `
+		SELECT
+			item::INT4 AS item,
+			count(DISTINCT killmail) AS fits,
+			count(DISTINCT CASE WHEN has THEN killmail END) AS cofits
+		FROM
+			(
+				SELECT
+					killmail, items, items @> $2 AS has
+				FROM
+					fits@fits_items_idx
+				WHERE
+					items @> $1
+				ORDER BY
+					killmail DESC
+				LIMIT
+					$3
+			)
+				AS f,
+			jsonb_array_elements_text(f.items) AS item
+		GROUP BY
+			item
+	`, ship, item, sample)
+	selectT.Stop()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		switch row.Item {
+		case int32(ship):
+			ret.Fits = row.Fits
+		case int32(item):
+			ret.ItemFits = row.CoFits
+		}
+	}
+	if ret.ItemFits == 0 {
+		return ret, nil
+	}
+	for _, row := range rows {
+		it, ok := s.Global.Items[row.Item]
+		if !ok || row.Item == int32(item) || row.CoFits == 0 || s.Global.Groups[it.Group].IsShip() {
+			continue
+		}
+		p := float64(row.CoFits) / float64(ret.ItemFits)
+		ret.Items = append(ret.Items, CoItem{
+			Item:    it,
+			Fits:    row.CoFits,
+			Percent: p * 100,
+			Lift:    p / (float64(row.Fits) / float64(ret.Fits)),
+		})
+	}
+	sort.Slice(ret.Items, func(i, j int) bool {
+		if ret.Items[i].Fits != ret.Items[j].Fits {
+			return ret.Items[i].Fits > ret.Items[j].Fits
+		}
+		return ret.Items[i].Lift > ret.Items[j].Lift
+	})
+	if len(ret.Items) > limit {
+		ret.Items = ret.Items[:limit]
+	}
+	return ret, nil
+}
+
+// Threats returns the attacker ships and weapons that most often killed a
+// ship, optionally only fits of it with fingerprint.
+func (s *EFContext) Threats(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	ship, _ := strconv.Atoi(r.FormValue("ship"))
+	if ship <= 0 {
+		return nil, errors.New("missing ship")
+	}
+	fingerprint := r.FormValue("fingerprint")
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	// Only the most recent kills are sampled to bound the query time.
+	const sample = 5000
+
+	type Threat struct {
+		Item
+		// Kills is the number of sampled kills with this attacker ship
+		// or weapon on the killmail.
+		Kills int64
+		// Percent is the percentage of sampled kills with this attacker
+		// ship or weapon.
+		Percent float64
+	}
+	var ret struct {
+		Ship        Item
+		Fingerprint string `json:",omitempty"`
+		// Kills is the number of sampled kills of the ship.
+		Kills   int64
+		Ships   []Threat
+		Weapons []Threat
+	}
+	ret.Ship = s.Global.Items[int32(ship)]
+	ret.Fingerprint = fingerprint
+
+	var rows []struct {
+		Kind  string
+		Item  int32
+		Kills int64
+	}
+	selectT := timing.NewMetric("select").Start()
+	err := s.X.SelectContext(ctx, &rows, `
+		WITH
+			f
+				AS (
+					SELECT
+						killmail, attacker_ships, attacker_weapons
+					FROM
+						fits
+					WHERE
+						ship = $1 AND ($2 = '' OR fingerprint = $2)
+					ORDER BY
+						killmail DESC
+					LIMIT
+						$3
+				)
+		SELECT
+			'' AS kind, 0 AS item, count(*) AS kills
+		FROM
+			f
+		UNION ALL
+			SELECT
+				'ship', item::INT4, count(DISTINCT killmail)
+			FROM
+				f, jsonb_array_elements_text(f.attacker_ships) AS item
+			GROUP BY
+				item
+		UNION ALL
+			SELECT
+				'weapon', item::INT4, count(DISTINCT killmail)
+			FROM
+				f, jsonb_array_elements_text(f.attacker_weapons) AS item
+			GROUP BY
+				item
+	`, ship, fingerprint, sample)
+	selectT.Stop()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		if row.Kind == "" {
+			ret.Kills = row.Kills
+		}
+	}
+	for _, row := range rows {
+		if ret.Kills == 0 {
+			break
+		}
+		t := Threat{
+			Item:    s.Global.Items[row.Item],
+			Kills:   row.Kills,
+			Percent: float64(row.Kills) * 100 / float64(ret.Kills),
+		}
+		t.ID = row.Item
+		switch row.Kind {
+		case "ship":
+			ret.Ships = append(ret.Ships, t)
+		case "weapon":
+			ret.Weapons = append(ret.Weapons, t)
+		}
+	}
+	for _, threats := range []*[]Threat{&ret.Ships, &ret.Weapons} {
+		t := *threats
+		sort.Slice(t, func(i, j int) bool {
+			return t[i].Kills > t[j].Kills
+		})
+		if len(t) > limit {
+			*threats = t[:limit]
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/cockroach-go/crdb"
+	servertiming "github.com/mitchellh/go-server-timing"
+	"github.com/pkg/errors"
+)
+
+// Kinds of trends rows. The total kind has a type of 0 and counts all
+// fits of the day.
+const (
+	TrendShip  = "ship"
+	TrendItem  = "item"
+	TrendTotal = "total"
+)
+
+// RollupTrends computes the daily number of fits per ship and per item into
+// the trends table. Only days in trend_days, which processing adds the
+// days of new fits to, are recomputed. Killmails can arrive days late, so
+// these aren't only recent days.
+func (s *EFContext) RollupTrends(ctx context.Context) {
+	dbCtx := context.Background()
+	var days []time.Time
+	if err := s.X.SelectContext(dbCtx, &days, `SELECT day FROM trend_days ORDER BY day`); err != nil {
+		log.Printf("rollup trends: %+v", err)
+		return
+	}
+	for _, day := range days {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := crdb.ExecuteTx(dbCtx, s.DB, nil, func(tx *sql.Tx) error {
+			if err := s.rollupDay(tx, day); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`DELETE FROM trend_days WHERE day = $1`, day)
+			return errors.Wrap(err, "trend days")
+		}); err != nil {
+			log.Printf("rollup trends %s: %+v", day.Format("2006-01-02"), err)
+			return
+		}
+		fmt.Println("rolled up trends", day.Format("2006-01-02"))
+	}
+}
+
+func (s *EFContext) rollupDay(tx *sql.Tx, day time.Time) error {
+	end := day.AddDate(0, 0, 1)
+	if _, err := tx.Exec(`DELETE FROM trends WHERE day = $1`, day); err != nil {
+		return errors.Wrap(err, "delete")
+	}
+	if _, err := tx.Exec(`
+		INSERT
+		INTO
+			trends (kind, type, day, count)
+		SELECT
+			$1, 0, $4, count(*)
+		FROM
+			fits
+		WHERE
+			killtime >= $4 AND killtime < $5
+		UNION ALL
+			SELECT
+				$2, ship, $4, count(*)
+			FROM
+				fits
+			WHERE
+				killtime >= $4 AND killtime < $5
+			GROUP BY
+				ship
+		UNION ALL
+			SELECT
+				$3, item::INT4, $4, count(DISTINCT killmail)
+			FROM
+				fits, jsonb_array_elements_text(items) AS item
+			WHERE
+				killtime >= $4 AND killtime < $5
+			GROUP BY
+				item
+	`, TrendTotal, TrendShip, TrendItem, day, end); err != nil {
+		return errors.Wrap(err, "insert")
+	}
+	return nil
+}
+
+// Trends returns the daily number of fits with each of the ship and item
+// parameters.
+func (s *EFContext) Trends(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	r.ParseForm()
+	// Series are zero-filled, so days is bounded by the size of a
+	// response.
+	days, _ := strconv.Atoi(r.FormValue("days"))
+	if days <= 0 || days > 730 {
+		days = 90
+	}
+	today := time.Now().UTC().Truncate(time.Hour * 24)
+	since := today.AddDate(0, 0, -days)
+
+	type Point struct {
+		Day   string
+		Count int64
+		// Total is the number of fits of all ships on the day.
+		Total int64
+	}
+	type Series struct {
+		Kind   string
+		Item   Item
+		Points []Point
+	}
+	var ret struct {
+		Days   int
+		Series []Series
+	}
+	ret.Days = days
+
+	// counts returns the counts of a kind and type by day.
+	counts := func(kind string, id int) (map[string]int64, error) {
+		var rows []struct {
+			Day   string
+			Count int64
+		}
+		selectT := timing.NewMetric("select").Start()
+		err := s.X.SelectContext(ctx, &rows, `
+			SELECT
+				day::STRING AS day, count
+			FROM
+				trends
+			WHERE
+				kind = $1 AND type = $2 AND day >= $3
+		`, kind, id, since)
+		selectT.Stop()
+		m := map[string]int64{}
+		for _, row := range rows {
+			m[row.Day] = row.Count
+		}
+		return m, err
+	}
+	totals, err := counts(TrendTotal, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, kind := range []string{TrendShip, TrendItem} {
+		for _, v := range r.Form[kind] {
+			id, _ := strconv.Atoi(v)
+			if id <= 0 {
+				continue
+			}
+			series := Series{
+				Kind: kind,
+				Item: s.Global.Items[int32(id)],
+			}
+			byDay, err := counts(kind, id)
+			if err != nil {
+				return nil, err
+			}
+			// Days without fits have no rows but are included as zeros
+			// so the series is continuous.
+			for day := since; !day.After(today); day = day.AddDate(0, 0, 1) {
+				key := day.Format("2006-01-02")
+				series.Points = append(series.Points, Point{
+					Day:   key,
+					Count: byDay[key],
+					Total: totals[key],
+				})
+			}
+			ret.Series = append(ret.Series, series)
+		}
+	}
+	if len(ret.Series) == 0 {
+		return nil, errors.New("missing ship or item")
+	}
+	return ret, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Dogma holds the fitting related dogma attributes and effects of a type.
+type Dogma struct {
+	Attributes map[int32]float64
+	Effects    []int32
+}
+
+func (d Dogma) HasEffect(effect int32) bool {
+	for _, e := range d.Effects {
+		if e == effect {
+			return true
+		}
+	}
+	return false
+}
+
+// Dogma attribute IDs.
+const (
+	AttrPowerOutput           = 11
+	AttrLowSlots              = 12
+	AttrMedSlots              = 13
+	AttrHiSlots               = 14
+	AttrPower                 = 30
+	AttrCPUOutput             = 48
+	AttrCPU                   = 50
+	AttrLauncherSlotsLeft     = 101
+	AttrTurretSlotsLeft       = 102
+	AttrPowerOutputMultiplier = 145
+	AttrCPUMultiplier         = 202
+	AttrPowerIncrease         = 549
+	AttrUpgradeCapacity       = 1132
+	AttrRigSlots              = 1137
+	AttrUpgradeCost           = 1153
+	AttrTurretHardPointMod    = 1368
+	AttrLauncherHardPointMod  = 1369
+	AttrHiSlotModifier        = 1374
+	AttrMedSlotModifier       = 1375
+	AttrLowSlotModifier       = 1376
+	AttrFitsToShipType        = 1380
+	AttrMaxGroupFitted        = 1544
+)
+
+// Dogma effect IDs.
+const (
+	EffectLauncherFitted = 40
+	EffectTurretFitted   = 42
+)
+
+// canFitShipGroupAttributes and canFitShipTypeAttributes restrict the
+// ships a module can be fitted to.
+var (
+	canFitShipGroupAttributes = []int32{1298, 1299, 1300, 1301, 1872, 1879, 1880, 1881, 2065, 2396, 2476, 2477, 2478, 2479, 2480, 2481, 2482, 2483, 2484, 2485}
+	canFitShipTypeAttributes  = []int32{1302, 1303, 1304, 1305, 1944, 2103, 2463, 2486, 2487, 2488}
+)
+
+// fittingAttributes and fittingEffects are the dogma attributes and
+// effects loaded from the SDE.
+var (
+	fittingAttributes = map[int32]bool{}
+	fittingEffects    = map[int32]bool{
+		EffectLauncherFitted: true,
+		EffectTurretFitted:   true,
+	}
+)
+
+func init() {
+	for _, a := range []int32{
+		AttrPowerOutput,
+		AttrLowSlots,
+		AttrMedSlots,
+		AttrHiSlots,
+		AttrPower,
+		AttrCPUOutput,
+		AttrCPU,
+		AttrLauncherSlotsLeft,
+		AttrTurretSlotsLeft,
+		AttrPowerOutputMultiplier,
+		AttrCPUMultiplier,
+		AttrPowerIncrease,
+		AttrUpgradeCapacity,
+		AttrRigSlots,
+		AttrUpgradeCost,
+		AttrTurretHardPointMod,
+		AttrLauncherHardPointMod,
+		AttrHiSlotModifier,
+		AttrMedSlotModifier,
+		AttrLowSlotModifier,
+		AttrFitsToShipType,
+		AttrMaxGroupFitted,
+	} {
+		fittingAttributes[a] = true
+	}
+	for _, a := range canFitShipGroupAttributes {
+		fittingAttributes[a] = true
+	}
+	for _, a := range canFitShipTypeAttributes {
+		fittingAttributes[a] = true
+	}
+}
+
+// fittingSkillBonus is the CPU and powergrid bonus of the CPU Management
+// and Power Grid Management skills at level V.
+const fittingSkillBonus = 1.25
+
+// Validate returns the reasons k's fit could not have been fitted, or nil
+// if it is valid. This catches things like offline modules and mismatched
+// subsystems.
+//
+// CPU and powergrid overuse are returned as warnings instead. They assume
+// max CPU Management and Power Grid Management skills but don't model
+// other skills (like Weapon Upgrades) or hull bonuses that reduce fitting
+// costs, so legitimate fits can exceed them.
+func (k KM) Validate(s *EFContext) (violations, warnings []string) {
+	ship := s.Global.Dogma[k.Victim.ShipTypeId]
+	hi, med, low, rig, sub, _ := k.Items(s)
+
+	slots := map[string]float64{
+		"hi":  ship.Attributes[AttrHiSlots],
+		"med": ship.Attributes[AttrMedSlots],
+		"low": ship.Attributes[AttrLowSlots],
+		"rig": ship.Attributes[AttrRigSlots],
+	}
+	turrets := ship.Attributes[AttrTurretSlotsLeft]
+	launchers := ship.Attributes[AttrLauncherSlotsLeft]
+	cpuOutput := ship.Attributes[AttrCPUOutput] * fittingSkillBonus
+	powerOutput := ship.Attributes[AttrPowerOutput] * fittingSkillBonus
+	var cpu, power, calibration float64
+	usedTurrets, usedLaunchers := 0, 0
+	groups := map[int32]int{}
+	maxGroup := map[int32]float64{}
+	used := map[string]int{}
+	for i, fitted := range [][8]ItemCharge{hi, med, low, rig, sub} {
+		slot := SlotTypes[i]
+		for _, ic := range fitted {
+			if ic.ID == 0 {
+				continue
+			}
+			used[slot]++
+			item := s.Global.Items[ic.ID]
+			d := s.Global.Dogma[ic.ID]
+			groups[item.Group]++
+			if m, ok := d.Attributes[AttrMaxGroupFitted]; ok {
+				maxGroup[item.Group] = m
+			}
+			cpu += d.Attributes[AttrCPU]
+			power += d.Attributes[AttrPower]
+			calibration += d.Attributes[AttrUpgradeCost]
+			if m, ok := d.Attributes[AttrCPUMultiplier]; ok {
+				cpuOutput *= m
+			}
+			if m, ok := d.Attributes[AttrPowerOutputMultiplier]; ok {
+				powerOutput *= m
+			}
+			powerOutput += d.Attributes[AttrPowerIncrease]
+			if d.HasEffect(EffectTurretFitted) {
+				usedTurrets++
+			}
+			if d.HasEffect(EffectLauncherFitted) {
+				usedLaunchers++
+			}
+			if slot == "sub" {
+				slots["hi"] += d.Attributes[AttrHiSlotModifier]
+				slots["med"] += d.Attributes[AttrMedSlotModifier]
+				slots["low"] += d.Attributes[AttrLowSlotModifier]
+				turrets += d.Attributes[AttrTurretHardPointMod]
+				launchers += d.Attributes[AttrLauncherHardPointMod]
+				if t, ok := d.Attributes[AttrFitsToShipType]; ok && int32(t) != k.Victim.ShipTypeId {
+					violations = append(violations, fmt.Sprintf("%s does not fit this ship", item.Name))
+				}
+			}
+			if !canFit(s, d, k.Victim.ShipTypeId) {
+				violations = append(violations, fmt.Sprintf("%s cannot be fitted to this ship", item.Name))
+			}
+		}
+	}
+	for _, slot := range []string{"hi", "med", "low", "rig"} {
+		if float64(used[slot]) > slots[slot] {
+			violations = append(violations, fmt.Sprintf("%d %s slots used of %v", used[slot], slot, slots[slot]))
+		}
+	}
+	if float64(usedTurrets) > turrets {
+		violations = append(violations, fmt.Sprintf("%d turrets fitted of %v hardpoints", usedTurrets, turrets))
+	}
+	if float64(usedLaunchers) > launchers {
+		violations = append(violations, fmt.Sprintf("%d launchers fitted of %v hardpoints", usedLaunchers, launchers))
+	}
+	if capacity := ship.Attributes[AttrUpgradeCapacity]; calibration > capacity {
+		violations = append(violations, fmt.Sprintf("%v calibration used of %v", calibration, capacity))
+	}
+	if cpu > cpuOutput {
+		warnings = append(warnings, fmt.Sprintf("%.1f CPU used of %.1f", cpu, cpuOutput))
+	}
+	if power > powerOutput {
+		warnings = append(warnings, fmt.Sprintf("%.1f powergrid used of %.1f", power, powerOutput))
+	}
+	for group, n := range groups {
+		if max, ok := maxGroup[group]; ok && float64(n) > max {
+			violations = append(violations, fmt.Sprintf("%d %s fitted of max %v", n, s.Global.Groups[group].Name, max))
+		}
+	}
+	return violations, warnings
+}
+
+// canFit reports whether a module with dogma d can be fitted to ship
+// based on its ship group and type restrictions.
+func canFit(s *EFContext, d Dogma, ship int32) bool {
+	restricted := false
+	group := float64(s.Global.Items[ship].Group)
+	for _, a := range canFitShipGroupAttributes {
+		if v, ok := d.Attributes[a]; ok {
+			restricted = true
+			if v == group {
+				return true
+			}
+		}
+	}
+	for _, a := range canFitShipTypeAttributes {
+		if v, ok := d.Attributes[a]; ok {
+			restricted = true
+			if v == float64(ship) {
+				return true
+			}
+		}
+	}
+	return !restricted
+}
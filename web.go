@@ -9,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,24 +20,41 @@ import (
 	"github.com/pkg/errors"
 )
 
-func (s *EFContext) Wrap(
-	f func(context.Context, *http.Request, *servertiming.Header) (interface{}, error),
-) http.HandlerFunc {
+type handler func(context.Context, *http.Request, *servertiming.Header) (interface{}, error)
+
+// Wrap returns an http.HandlerFunc of f whose responses can be cached.
+func (s *EFContext) Wrap(f handler) http.HandlerFunc {
+	return s.wrap(f, true)
+}
+
+// WrapUncached returns an http.HandlerFunc of f whose responses must not
+// be cached, like those that change or return mutable data.
+func (s *EFContext) WrapUncached(f handler) http.HandlerFunc {
+	return s.wrap(f, false)
+}
+
+func (s *EFContext) wrap(f handler, cache bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		s.allowOrigin(w, r)
 		if r.Method == http.MethodOptions {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+csrfHeader)
 			w.Header().Set("Access-Control-Max-Age", "3600")
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 
 		ctx, cancel := context.WithTimeout(r.Context(), time.Second*60)
 		defer cancel()
 		var sh servertiming.Header
 		ctx = servertiming.NewContext(ctx, &sh)
+		sess, err := s.loadSession(ctx, r)
+		if err != nil {
+			log.Printf("load session: %+v", err)
+		}
+		if sess != nil {
+			ctx = context.WithValue(ctx, sessionKey{}, sess)
+		}
 		if v, err := url.ParseQuery(r.URL.RawQuery); err == nil {
 			r.URL.RawQuery = v.Encode()
 		}
@@ -59,112 +77,418 @@ func (s *EFContext) Wrap(
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if file, ok := res.(*File); ok {
+			file.write(w, cache && sess == nil)
+			return
+		}
 		data, gzip, err := resultToBytes(res)
 		if err != nil {
 			log.Printf("%s: %v", url, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		writeDataGzip(w, r, data, gzip)
+		// Responses can depend on the session.
+		writeDataGzip(w, r, data, gzip, cache && sess == nil)
 	}
 }
 
 func (s *EFContext) Fit(
 	ctx context.Context, r *http.Request, timing *servertiming.Header,
 ) (interface{}, error) {
-	id := r.FormValue("id")
-	if id == "" {
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	if id <= 0 {
 		return nil, errors.New("missing fit id")
 	}
+	hub, err := parseHub(r)
+	if err != nil {
+		return nil, err
+	}
+	return s.fit(ctx, int32(id), hub)
+}
+
+// Entity is a character and its corporation and alliance.
+type Entity struct {
+	Character   int32 `json:",omitempty"`
+	Corporation int32 `json:",omitempty"`
+	Alliance    int32 `json:",omitempty"`
+}
+
+type Attacker struct {
+	Entity
+	Ship       Item
+	Weapon     Item
+	DamageDone int32
+	FinalBlow  bool
+}
+
+// FitResult is a killmail's fit and details.
+type FitResult struct {
+	Killmail               int32
+	Zkb                    Zkb
+	Ship                   Item
+	SolarSystem            System
+	Region                 Region
+	Security               string
+	Violations             []string
+	Warnings               []string
+	Victim                 Entity
+	Attackers              []Attacker
+	Names                  map[int32]string `json:",omitempty"`
+	Prices                 *PriceBreakdown  `json:",omitempty"`
+	Hi, Med, Low, Rig, Sub [8]ItemCharge
+}
 
+// fit returns the fit of killmail id, priced at hub if not empty.
+func (s *EFContext) fit(ctx context.Context, id int32, hub string) (*FitResult, error) {
 	var rawKM, rawZKB []byte
 	var kmid int32
 	if err := s.DB.QueryRowContext(ctx, `SELECT id, km, zkb from killmails where id = $1`, id).Scan(&kmid, &rawKM, &rawZKB); err != nil {
 		return nil, err
 	}
 	var km KM
-	err := json.Unmarshal(rawKM, &km)
+	if err := json.Unmarshal(rawKM, &km); err != nil {
+		return nil, err
+	}
 	var zkb Zkb
 	json.Unmarshal(rawZKB, &zkb)
+	var prices *PriceBreakdown
+	if hub != "" {
+		var err error
+		prices, err = s.HubBreakdown(ctx, hub, km)
+		if err != nil {
+			return nil, err
+		}
+	}
+	f := s.fitResult(kmid, km, zkb)
+	f.Violations, f.Warnings = km.Validate(s)
+	f.Names = s.ResolveNames(ctx, f.nameIDs())
+	f.Prices = prices
+	return f, nil
+}
+
+// fitResult returns the fit of km without the names, validation, or
+// prices that fit adds.
+func (s *EFContext) fitResult(kmid int32, km KM, zkb Zkb) *FitResult {
 	hi, med, low, rig, sub, _ := km.Items(s)
-	return struct {
-		Killmail               int32
-		Zkb                    Zkb
-		Ship                   Item
-		Hi, Med, Low, Rig, Sub [8]ItemCharge
-	}{
-		Killmail: kmid,
-		Zkb:      zkb,
-		Ship:     s.Global.Items[km.Victim.ShipTypeId],
-		Hi:       hi,
-		Med:      med,
-		Low:      low,
-		Rig:      rig,
-		Sub:      sub,
-	}, err
+	system := s.Global.Systems[km.SolarSystemId]
+	attackers := make([]Attacker, len(km.Attackers))
+	for i, a := range km.Attackers {
+		attackers[i] = Attacker{
+			Entity: Entity{
+				Character:   a.CharacterId,
+				Corporation: a.CorporationId,
+				Alliance:    a.AllianceId,
+			},
+			Ship:       s.Global.Items[a.ShipTypeId],
+			Weapon:     s.Global.Items[a.WeaponTypeId],
+			DamageDone: a.DamageDone,
+			FinalBlow:  a.FinalBlow,
+		}
+	}
+	return &FitResult{
+		Killmail:    kmid,
+		Zkb:         zkb,
+		Ship:        s.Global.Items[km.Victim.ShipTypeId],
+		SolarSystem: system,
+		Region:      s.Global.Regions[system.Region],
+		Security:    system.Band(),
+		Victim: Entity{
+			Character:   km.Victim.CharacterId,
+			Corporation: km.Victim.CorporationId,
+			Alliance:    km.Victim.AllianceId,
+		},
+		Attackers: attackers,
+		Hi:        hi,
+		Med:       med,
+		Low:       low,
+		Rig:       rig,
+		Sub:       sub,
+	}
+}
+
+// nameIDs returns the character, corporation, and alliance IDs of f's
+// victim and attackers.
+func (f *FitResult) nameIDs() []int32 {
+	ids := []int32{f.Victim.Character, f.Victim.Corporation, f.Victim.Alliance}
+	for _, a := range f.Attackers {
+		ids = append(ids, a.Character, a.Corporation, a.Alliance)
+	}
+	return ids
+}
+
+// FilterItem is a filter applied by Fits. Value is its form value, which
+// removes the filter from a query.
+type FilterItem struct {
+	Item
+	Value string
 }
 
 func (s *EFContext) Fits(
 	ctx context.Context, r *http.Request, timing *servertiming.Header,
 ) (interface{}, error) {
 	var ret struct {
-		Filter map[string][]Item
+		Filter map[string][]FilterItem
+		Names  map[int32]string
+		Hub    string `json:",omitempty"`
 		Fits   []*struct {
 			Killmail              int
 			Ship                  int32
 			Name                  string
 			Cost                  int64
-			HiRaw, MedRaw, LowRaw []byte `json:"-"`
+			SolarSystem           int32
+			System, Region        string `db:"-"`
+			Valid                 bool
+			Character             int32 `json:",omitempty"`
+			Corporation           int32 `json:",omitempty"`
+			Alliance              int32 `json:",omitempty"`
+			Attackers             int
+			Engagement            string
+			Prices                *PriceBreakdown `json:",omitempty" db:"-"`
+			HiRaw, MedRaw, LowRaw []byte          `json:"-"`
 			Hi, Med, Lo           []Item
 		}
 	}
-	ret.Filter = map[string][]Item{}
+	ret.Filter = map[string][]FilterItem{}
+	addFilter := func(name, value string, item Item) {
+		ret.Filter[name] = append(ret.Filter[name], FilterItem{Item: item, Value: value})
+	}
 	r.ParseForm()
+	hub, err := parseHub(r)
+	if err != nil {
+		return nil, err
+	}
 
 	var sb strings.Builder
 	var args []interface{}
+	// index is set to an index hint when a predicate that can use an
+	// inverted index is added.
+	var index string
 	if ship, _ := strconv.Atoi(r.Form.Get("ship")); ship > 0 {
 		args = append(args, ship)
 		fmt.Fprintf(&sb, ` AND items @> $%d`, len(args))
-		ret.Filter["ship"] = append(ret.Filter["ship"], s.Global.Items[int32(ship)])
+		index = "fits_items_idx"
+		addFilter("ship", r.Form.Get("ship"), s.Global.Items[int32(ship)])
 	}
 	var items []int
 	for _, item := range r.Form["item"] {
-		itemid, _ := strconv.Atoi(item)
+		itemid, op, count, err := parseItemCount(item)
+		if err != nil {
+			return nil, err
+		}
 		if itemid <= 0 {
 			continue
 		}
-		items = append(items, itemid)
-		ret.Filter["item"] = append(ret.Filter["item"], s.Global.Items[int32(itemid)])
+		it := s.Global.Items[int32(itemid)]
+		if op == "" {
+			items = append(items, itemid)
+			addFilter("item", item, it)
+			continue
+		}
+		args = append(args, strconv.Itoa(itemid), count)
+		fmt.Fprintf(&sb, ` AND COALESCE((counts->>$%d)::INT8, 0) %s $%d`, len(args)-1, op, len(args))
+		// If the constraint excludes fits without the item, the items
+		// index can be used.
+		if !compareCount(0, op, count) {
+			items = append(items, itemid)
+		}
+		it.Name = fmt.Sprintf("%s %s%d", it.Name, op, count)
+		addFilter("item", item, it)
 	}
 	if len(items) > 0 {
 		args = append(args, pq.Array(items))
 		fmt.Fprintf(&sb, ` AND items @> array_to_json($%d::int[])`, len(args))
+		index = "fits_items_idx"
 	}
+	// Slot filters also constrain items, which is a superset of each slot
+	// column, so that the inverted index on items can be used.
+	for _, slot := range SlotTypes {
+		var slotItems []int
+		for _, item := range r.Form[slot] {
+			itemid, _ := strconv.Atoi(item)
+			if itemid <= 0 {
+				continue
+			}
+			slotItems = append(slotItems, itemid)
+			addFilter(slot, item, s.Global.Items[int32(itemid)])
+		}
+		if len(slotItems) == 0 {
+			continue
+		}
+		args = append(args, pq.Array(slotItems))
+		fmt.Fprintf(&sb, ` AND items @> array_to_json($%[1]d::int[]) AND %[2]s @> array_to_json($%[1]d::int[])`, len(args), slot)
+		index = "fits_items_idx"
+	}
+	var groups []int
 	for _, group := range r.Form["group"] {
 		groupid, _ := strconv.Atoi(group)
 		if groupid <= 0 {
 			continue
 		}
-		gid := int32(groupid)
-		sb.WriteString(` AND (`)
-		or := ""
-		for id, item := range s.Global.Items {
-			if item.Group != gid {
-				continue
-			}
-			args = append(args, id)
-			sb.WriteString(or)
-			or = " OR "
-			fmt.Fprintf(&sb, ` items @> $%d`, len(args))
-		}
-		sb.WriteString(`)`)
-		g := s.Global.Groups[gid]
-		ret.Filter["group"] = append(ret.Filter["group"], Item{
+		groups = append(groups, groupid)
+		g := s.Global.Groups[int32(groupid)]
+		addFilter("group", group, Item{
+			Name: g.Name,
+			ID:   g.ID,
+		})
+	}
+	if len(groups) > 0 {
+		args = append(args, pq.Array(groups))
+		fmt.Fprintf(&sb, ` AND groups @> array_to_json($%d::int[])`, len(args))
+		// Prefer the items index if there's also an item filter since it
+		// is usually more selective.
+		if index == "" {
+			index = "fits_groups_idx"
+		}
+	}
+	var categories []int
+	for _, category := range r.Form["category"] {
+		categoryid, _ := strconv.Atoi(category)
+		if categoryid <= 0 {
+			continue
+		}
+		categories = append(categories, categoryid)
+		addFilter("category", category, Item{
+			Name: categoryNames[int32(categoryid)],
+			ID:   int32(categoryid),
+		})
+	}
+	if len(categories) > 0 {
+		args = append(args, pq.Array(categories))
+		fmt.Fprintf(&sb, ` AND categories @> array_to_json($%d::int[])`, len(args))
+		if index == "" {
+			index = "fits_categories_idx"
+		}
+	}
+	// Negated filters can't use an inverted index, so they don't set index.
+	for _, item := range r.Form["not_item"] {
+		itemid, _ := strconv.Atoi(item)
+		if itemid <= 0 {
+			continue
+		}
+		args = append(args, itemid)
+		fmt.Fprintf(&sb, ` AND NOT (items @> $%d)`, len(args))
+		addFilter("not_item", item, s.Global.Items[int32(itemid)])
+	}
+	for _, group := range r.Form["not_group"] {
+		groupid, _ := strconv.Atoi(group)
+		if groupid <= 0 {
+			continue
+		}
+		args = append(args, groupid)
+		fmt.Fprintf(&sb, ` AND NOT (groups @> $%d)`, len(args))
+		g := s.Global.Groups[int32(groupid)]
+		addFilter("not_group", group, Item{
 			Name: g.Name,
 			ID:   g.ID,
 		})
 	}
+	// Location filters of the same kind are OR'd together. Each kind is
+	// converted to a list of solar systems.
+	for _, loc := range []struct {
+		name  string
+		match func(id int32, sys System) bool
+		item  func(id int32) Item
+	}{
+		{
+			name:  "system",
+			match: func(id int32, sys System) bool { return sys.ID == id },
+			item:  func(id int32) Item { return Item{ID: id, Name: s.Global.Systems[id].Name} },
+		},
+		{
+			name:  "constellation",
+			match: func(id int32, sys System) bool { return sys.Constellation == id },
+			item:  func(id int32) Item { return Item{ID: id, Name: s.Global.Constellations[id].Name} },
+		},
+		{
+			name:  "region",
+			match: func(id int32, sys System) bool { return sys.Region == id },
+			item:  func(id int32) Item { return Item{ID: id, Name: s.Global.Regions[id].Name} },
+		},
+	} {
+		var ids []int32
+		for _, v := range r.Form[loc.name] {
+			id, _ := strconv.Atoi(v)
+			if id <= 0 {
+				continue
+			}
+			ids = append(ids, int32(id))
+			addFilter(loc.name, v, loc.item(int32(id)))
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		var systems []int32
+		for _, sys := range s.Global.Systems {
+			for _, id := range ids {
+				if loc.match(id, sys) {
+					systems = append(systems, sys.ID)
+					break
+				}
+			}
+		}
+		args = append(args, pq.Array(systems))
+		fmt.Fprintf(&sb, ` AND solarsystem = ANY ($%d::INT4[])`, len(args))
+	}
+	if bands := r.Form["security"]; len(bands) > 0 {
+		want := map[string]bool{}
+		for _, b := range bands {
+			switch b {
+			case Highsec, Lowsec, Nullsec, Wormhole:
+				want[b] = true
+				addFilter("security", b, Item{Name: b})
+			default:
+				return nil, errors.Errorf("unknown security: %s", b)
+			}
+		}
+		var systems []int32
+		for _, sys := range s.Global.Systems {
+			if want[sys.Band()] {
+				systems = append(systems, sys.ID)
+			}
+		}
+		args = append(args, pq.Array(systems))
+		fmt.Fprintf(&sb, ` AND solarsystem = ANY ($%d::INT4[])`, len(args))
+	}
+
+	// Entity filters of the same kind are OR'd together.
+	for _, col := range []string{"character", "corporation", "alliance"} {
+		var ids []int
+		for _, v := range r.Form[col] {
+			id, _ := strconv.Atoi(v)
+			if id <= 0 {
+				continue
+			}
+			ids = append(ids, id)
+			addFilter(col, v, Item{ID: int32(id)})
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		args = append(args, pq.Array(ids))
+		fmt.Fprintf(&sb, ` AND %s = ANY ($%d::INT4[])`, col, len(args))
+	}
+	if engagements := r.Form["engagement"]; len(engagements) > 0 {
+		for _, e := range engagements {
+			switch e {
+			case EngagementSolo, EngagementSmall, EngagementFleet:
+				addFilter("engagement", e, Item{Name: e})
+			default:
+				return nil, errors.Errorf("unknown engagement: %s", e)
+			}
+		}
+		args = append(args, pq.Array(engagements))
+		fmt.Fprintf(&sb, ` AND engagement = ANY ($%d::STRING[])`, len(args))
+	}
+	for _, col := range []string{"npc", "awox"} {
+		if v, _ := strconv.ParseBool(r.Form.Get("exclude_" + col)); v {
+			fmt.Fprintf(&sb, ` AND NOT %s`, col)
+			addFilter("exclude_"+col, r.Form.Get("exclude_"+col), Item{Name: col})
+		}
+	}
+	if v, _ := strconv.ParseBool(r.Form.Get("valid_only")); v {
+		sb.WriteString(` AND valid`)
+		addFilter("valid_only", r.Form.Get("valid_only"), Item{Name: "valid fits"})
+	}
 
 	var query strings.Builder
 	query.WriteString(`
@@ -172,59 +496,330 @@ func (s *EFContext) Fits(
 			killmail,
 			ship,
 			cost,
+			solarsystem,
+			valid,
+			COALESCE(character, 0) AS character,
+			COALESCE(corporation, 0) AS corporation,
+			COALESCE(alliance, 0) AS alliance,
+			attackers,
+			engagement,
 			hi AS hiraw,
 			med AS medraw,
 			low AS lowraw
 		FROM
 	`)
-	if len(args) > 0 {
+	if index != "" {
 		// TODO: without this hint, the primary index is used with a full scan.
-		query.WriteString(`fits@fits_items_idx WHERE TRUE`)
-		query.WriteString(sb.String())
+		query.WriteString(`fits@` + index)
 	} else {
 		query.WriteString(`fits`)
 	}
+	query.WriteString(` WHERE TRUE`)
+	query.WriteString(sb.String())
 	query.WriteString(`
 		ORDER BY
 			killmail DESC
 		LIMIT
 			100
 	`)
-	selectT := timing.NewMetric("select").Start()
-	err := s.X.SelectContext(ctx, &ret.Fits, query.String(), args...)
+	// The index is in the metric description so the timings of queries
+	// using different indexes can be compared.
+	selectT := timing.NewMetric("select").WithDesc(index).Start()
+	err = s.X.SelectContext(ctx, &ret.Fits, query.String(), args...)
 	selectT.Stop()
+	if err != nil {
+		return nil, err
+	}
 
-	var his, meds, los []int32
+	var ids []int32
 	for _, f := range ret.Fits {
 		f.Name = s.Global.Items[f.Ship].Name
-		json.Unmarshal(f.HiRaw, &his)
-		json.Unmarshal(f.MedRaw, &meds)
-		json.Unmarshal(f.LowRaw, &los)
-		for _, v := range his {
-			item := s.Global.Items[v]
-			if s.Global.Groups[item.Group].IsCharge() {
-				continue
-			}
-			f.Hi = append(f.Hi, item)
+		sys := s.Global.Systems[f.SolarSystem]
+		f.System = sys.Name
+		f.Region = s.Global.Regions[sys.Region].Name
+		f.Hi = s.modules(f.HiRaw)
+		f.Med = s.modules(f.MedRaw)
+		f.Lo = s.modules(f.LowRaw)
+		ids = append(ids, f.Character, f.Corporation, f.Alliance)
+	}
+	for _, col := range []string{"character", "corporation", "alliance"} {
+		for _, item := range ret.Filter[col] {
+			ids = append(ids, item.ID)
 		}
-		for _, v := range meds {
-			item := s.Global.Items[v]
-			if s.Global.Groups[item.Group].IsCharge() {
-				continue
-			}
-			f.Med = append(f.Med, item)
+	}
+	namesT := timing.NewMetric("names").Start()
+	ret.Names = s.ResolveNames(ctx, ids)
+	namesT.Stop()
+	for _, col := range []string{"character", "corporation", "alliance"} {
+		for i, item := range ret.Filter[col] {
+			ret.Filter[col][i].Name = ret.Names[item.ID]
 		}
-		for _, v := range los {
-			item := s.Global.Items[v]
-			if s.Global.Groups[item.Group].IsCharge() {
-				continue
-			}
-			f.Lo = append(f.Lo, item)
+	}
+	if hub != "" {
+		// Fits are priced from their killmails, like Fit, since the fits
+		// table doesn't have item quantities or slots.
+		kmids := make([]int32, len(ret.Fits))
+		for i, f := range ret.Fits {
+			kmids[i] = int32(f.Killmail)
+		}
+		pricesT := timing.NewMetric("prices").Start()
+		kms, err := s.loadKillmails(ctx, kmids)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]KM, len(ret.Fits))
+		for i, id := range kmids {
+			list[i] = kms[id]
+		}
+		prices, err := s.HubBreakdowns(ctx, hub, list)
+		pricesT.Stop()
+		if err != nil {
+			return nil, err
+		}
+		for i, f := range ret.Fits {
+			f.Prices = prices[i]
 		}
+		ret.Hub = hub
 	}
+	return ret, nil
+}
+
+// modules returns the non-charge items of a JSON array of type IDs from
+// one of the slot columns of fits.
+func (s *EFContext) modules(raw []byte) []Item {
+	var ids []int32
+	json.Unmarshal(raw, &ids)
+	var items []Item
+	for _, v := range ids {
+		item := s.Global.Items[v]
+		if s.Global.Groups[item.Group].IsCharge() {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// PopularFits returns the most common fits of a ship, grouped by their
+// fingerprint.
+func (s *EFContext) PopularFits(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	ship, _ := strconv.Atoi(r.FormValue("ship"))
+	if ship <= 0 {
+		return nil, errors.New("missing ship")
+	}
+	days, _ := strconv.Atoi(r.FormValue("days"))
+	if days <= 0 {
+		days = 30
+	}
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 10
+	}
+	var ret struct {
+		Ship Item
+		Days int
+		Fits []*PopularFit
+	}
+	ret.Ship = s.Global.Items[int32(ship)]
+	ret.Days = days
+
+	var err error
+	ret.Fits, err = s.popularFits(ctx, timing, ship, time.Now().AddDate(0, 0, -days), limit)
 	return ret, err
 }
 
+// PopularFit is a group of identical fits.
+type PopularFit struct {
+	Fingerprint string
+	Count       int
+	// Cost is the average cost of fits with a known cost.
+	Cost int64
+	// Killmail is the most recent killmail with this fit.
+	Killmail                              int
+	HiRaw, MedRaw, LowRaw, RigRaw, SubRaw []byte `json:"-"`
+	Hi, Med, Lo, Rig, Sub                 []Item
+}
+
+// Modules returns the type IDs of the modules in each slot type.
+func (p *PopularFit) Modules() Modules {
+	var m Modules
+	for i, items := range [][]Item{p.Hi, p.Med, p.Lo, p.Rig, p.Sub} {
+		for _, item := range items {
+			m[i] = append(m[i], item.ID)
+		}
+	}
+	return m
+}
+
+// popularFits returns the limit most common fingerprints of ship killed
+// after since.
+func (s *EFContext) popularFits(
+	ctx context.Context, timing *servertiming.Header, ship int, since time.Time, limit int,
+) ([]*PopularFit, error) {
+	var fits []*PopularFit
+	selectT := timing.NewMetric("select").Start()
+	err := s.X.SelectContext(ctx, &fits, `
+		SELECT
+			p.fingerprint,
+			p.count,
+			p.cost,
+			p.killmail,
+			f.hi AS hiraw,
+			f.med AS medraw,
+			f.low AS lowraw,
+			f.rig AS rigraw,
+			f.sub AS subraw
+		FROM
+			(
+				SELECT
+					fingerprint,
+					count(*) AS count,
+					COALESCE(avg(NULLIF(cost, 0)), 0)::INT8 AS cost,
+					max(killmail) AS killmail
+				FROM
+					fits
+				WHERE
+					ship = $1 AND killtime > $2
+				GROUP BY
+					fingerprint
+				ORDER BY
+					count DESC
+				LIMIT
+					$3
+			)
+				AS p
+			JOIN fits AS f ON f.killmail = p.killmail
+		ORDER BY
+			p.count DESC, p.killmail DESC
+	`, ship, since, limit)
+	selectT.Stop()
+
+	for _, f := range fits {
+		f.Hi = s.modules(f.HiRaw)
+		f.Med = s.modules(f.MedRaw)
+		f.Lo = s.modules(f.LowRaw)
+		f.Rig = s.modules(f.RigRaw)
+		f.Sub = s.modules(f.SubRaw)
+	}
+	return fits, err
+}
+
+// SimilarFits returns fits of the same ship ranked by their similarity to
+// a killmail (id) or EFT fitting (eft).
+func (s *EFContext) SimilarFits(
+	ctx context.Context, r *http.Request, timing *servertiming.Header,
+) (interface{}, error) {
+	var ship Item
+	var target Modules
+	if id := r.FormValue("id"); id != "" {
+		var rawKM []byte
+		if err := s.DB.QueryRowContext(ctx, `SELECT km FROM killmails WHERE id = $1`, id).Scan(&rawKM); err != nil {
+			return nil, err
+		}
+		var km KM
+		if err := json.Unmarshal(rawKM, &km); err != nil {
+			return nil, err
+		}
+		ship = s.Global.Items[km.Victim.ShipTypeId]
+		target = km.Modules(s)
+	} else if eft := r.FormValue("eft"); eft != "" {
+		fit, err := s.ParseEFT(eft)
+		if err != nil {
+			return nil, err
+		}
+		ship = fit.Ship
+		target = fit.Modules
+	} else {
+		return nil, errors.New("missing id or eft")
+	}
+	days, _ := strconv.Atoi(r.FormValue("days"))
+	if days <= 0 {
+		days = 90
+	}
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	// Compare against the most common fingerprints instead of every fit
+	// since identical fits have the same score.
+	const candidates = 1000
+	fits, err := s.popularFits(ctx, timing, int(ship.ID), time.Now().AddDate(0, 0, -days), candidates)
+	if err != nil {
+		return nil, err
+	}
+	type SimilarFit struct {
+		*PopularFit
+		Score float64
+	}
+	var ret struct {
+		Ship Item
+		Fits []SimilarFit
+	}
+	ret.Ship = ship
+	scoreT := timing.NewMetric("score").Start()
+	for _, f := range fits {
+		ret.Fits = append(ret.Fits, SimilarFit{
+			PopularFit: f,
+			Score:      target.Similarity(f.Modules()),
+		})
+	}
+	sort.SliceStable(ret.Fits, func(i, j int) bool {
+		return ret.Fits[i].Score > ret.Fits[j].Score
+	})
+	if len(ret.Fits) > limit {
+		ret.Fits = ret.Fits[:limit]
+	}
+	scoreT.Stop()
+	return ret, nil
+}
+
+// parseItemCount parses an item filter of the form ID or ID:<op><count>,
+// where op is one of =, >, >=, < or <=. op is empty if there's no count
+// constraint.
+func parseItemCount(v string) (id int, op string, count int, err error) {
+	idx := strings.IndexByte(v, ':')
+	if idx < 0 {
+		id, _ = strconv.Atoi(v)
+		return id, "", 0, nil
+	}
+	id, _ = strconv.Atoi(v[:idx])
+	c := v[idx+1:]
+	for _, o := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(c, o) {
+			op = o
+			c = c[len(o):]
+			break
+		}
+	}
+	if op == "" {
+		op = "="
+	}
+	count, err = strconv.Atoi(c)
+	if err != nil || count < 0 {
+		return 0, "", 0, errors.Errorf("bad item count: %s", v)
+	}
+	return id, op, count, nil
+}
+
+// compareCount reports whether n satisfies the constraint op count.
+func compareCount(n int, op string, count int) bool {
+	switch op {
+	case ">=":
+		return n >= count
+	case "<=":
+		return n <= count
+	case ">":
+		return n > count
+	case "<":
+		return n < count
+	default:
+		return n == count
+	}
+}
+
 var searchCategories = map[int32]string{
 	6:  "ship",
 	7:  "item", // module
@@ -263,7 +858,9 @@ func (s *EFContext) Search(
 		return containsAll
 	}
 	for id, group := range s.Global.Groups {
-		if !match(strings.ToLower(group.Name)) {
+		// Drone and fighter groups are only loaded to name attackers'
+		// weapons. They aren't in fits, so can't be filtered by.
+		if searchCategories[group.Category] == "" || !match(strings.ToLower(group.Name)) {
 			continue
 		}
 		ret.Results = append(ret.Results, Result{
@@ -297,8 +894,11 @@ func (s *EFContext) Sync(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 	var wg sync.WaitGroup
 	for name, f := range map[string]func(context.Context){
-		"FetchHashes": s.FetchHashes,
-		"ProcessFits": s.ProcessFits,
+		"DeleteExpired": s.DeleteExpired,
+		"FetchHashes":   s.FetchHashes,
+		"ProcessFits":   s.ProcessFits,
+		"RollupTrends":  s.RollupTrends,
+		"SyncPrices":    s.SyncPrices,
 	} {
 		f := f
 		name := name
@@ -329,9 +929,34 @@ func resultToBytes(res interface{}) (data, gzipped []byte, err error) {
 	return data, gz.Bytes(), nil
 }
 
-func writeDataGzip(w http.ResponseWriter, r *http.Request, data, gzip []byte) {
+// File is a handler result that is written as is instead of as JSON.
+type File struct {
+	ContentType string
+	// Name, if set, is the file name that the response is downloaded as.
+	Name string
+	Data []byte
+}
+
+func (f *File) write(w http.ResponseWriter, cache bool) {
+	w.Header().Set("Content-Type", f.ContentType)
+	if f.Name != "" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", f.Name))
+	}
+	if cache {
+		w.Header().Add("Cache-Control", "max-age=3600")
+	} else {
+		w.Header().Add("Cache-Control", "no-store")
+	}
+	w.Write(f.Data)
+}
+
+func writeDataGzip(w http.ResponseWriter, r *http.Request, data, gzip []byte, cache bool) {
 	w.Header().Add("Content-Type", "application/json")
-	w.Header().Add("Cache-Control", "max-age=3600")
+	if cache {
+		w.Header().Add("Cache-Control", "max-age=3600")
+	} else {
+		w.Header().Add("Cache-Control", "no-store")
+	}
 	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
 		w.Header().Add("Content-Encoding", "gzip")
 		w.Write(gzip)